@@ -0,0 +1,162 @@
+package coalago
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	m "github.com/gusleein/coalago/message"
+	"github.com/gusleein/coalago/util"
+	"github.com/patrickmn/go-cache"
+)
+
+// CacheEntry is a response kept by the client cache.
+type CacheEntry struct {
+	Response *Response
+	Expires  time.Time
+}
+
+// CacheStore keeps the responses of a Client created WithCache. Entries
+// stay in the store after they expire so that they can be revalidated.
+type CacheStore interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+	Delete(key string)
+}
+
+type memoryCache struct {
+	c         *cache.Cache
+	keepStale time.Duration
+}
+
+// NewMemoryCache returns a CacheStore in memory which drops the entries
+// that have been stale for longer than keepStale, or keeps them forever
+// if keepStale is 0.
+func NewMemoryCache(keepStale time.Duration) CacheStore {
+	return &memoryCache{c: cache.New(keepStale, keepStale), keepStale: keepStale}
+}
+
+func (mc *memoryCache) Get(key string) (*CacheEntry, bool) {
+	if v, ok := mc.c.Get(key); ok {
+		return v.(*CacheEntry), true
+	}
+	return nil, false
+}
+
+func (mc *memoryCache) Set(key string, entry *CacheEntry) {
+	if mc.keepStale == 0 {
+		mc.c.Set(key, entry, cache.NoExpiration)
+		return
+	}
+	d := time.Until(entry.Expires) + mc.keepStale
+	if d < mc.keepStale {
+		d = mc.keepStale
+	}
+	mc.c.Set(key, entry, d)
+}
+
+func (mc *memoryCache) Delete(key string) {
+	mc.c.Delete(key)
+}
+
+// cacheKey identifies a request by its endpoint, method and the options
+// that are part of the cache key.
+func cacheKey(message *m.CoAPMessage, addr string) string {
+	var options []*m.CoAPMessageOption
+	for _, option := range message.Options {
+		switch {
+		case option.IsNoCacheKey(), option.Code == m.OptionEtag,
+			option.Code == m.OptionBlock1, option.Code == m.OptionBlock2:
+			continue
+		}
+		options = append(options, option)
+	}
+	// repeatable options keep their relative order
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Code < options[j].Code })
+
+	key := make([]string, 0, len(options))
+	for _, option := range options {
+		key = append(key, fmt.Sprintf("%d=%v", option.Code, option.Value))
+	}
+	return fmt.Sprintf("%s %d %s", addr, message.Code, strings.Join(key, ";"))
+}
+
+// sendCached answers a GET from the cache of the client if it has a fresh
+// response, otherwise sends the request, revalidating a stale response
+// with its ETag, and caches the answer. A response from the cache has no
+// RTT and Retransmits, RemoteAddr is the one it was received from.
+func (c *Client) sendCached(message *m.CoAPMessage, addr string) (*Response, error) {
+	store := c.cfg.cache
+	if store == nil || message.Code != m.GET {
+		return c.sendCONMessage(message, addr)
+	}
+
+	key := cacheKey(message, addr)
+	entry, ok := store.Get(key)
+	if ok && time.Now().Before(entry.Expires) {
+		util.MetricCacheHits.Inc()
+		resp := copyResponse(entry.Response)
+		resp.RTT, resp.Retransmits = 0, 0
+		return resp, nil
+	}
+	util.MetricCacheMisses.Inc()
+
+	var etag []byte
+	if ok && message.GetOption(m.OptionEtag) == nil {
+		if etag = entry.Response.ETag(); etag != nil {
+			message.AddOption(m.OptionEtag, string(etag))
+		}
+	}
+
+	resp, err := c.sendCONMessage(message, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.Code == m.CoapCodeValid && etag != nil:
+		util.MetricCacheRevalidations.Inc()
+		valid := *entry.Response
+		valid.Options = freshOptions(valid.Options, resp)
+		valid.RemoteAddr, valid.RTT, valid.Retransmits = resp.RemoteAddr, resp.RTT, resp.Retransmits
+		store.Set(key, &CacheEntry{Response: &valid, Expires: time.Now().Add(resp.MaxAge())})
+		return copyResponse(&valid), nil
+	case resp.Code == m.CoapCodeContent:
+		store.Set(key, &CacheEntry{Response: resp, Expires: time.Now().Add(resp.MaxAge())})
+		return copyResponse(resp), nil
+	case resp.Code == m.CoapCodeValid:
+		// validation asked for by the caller, nothing to update
+	default:
+		store.Delete(key)
+	}
+	return resp, nil
+}
+
+// freshOptions updates the options of a cached response with the Max-Age
+// and ETag of the 2.03 Valid response it was revalidated with.
+func freshOptions(cached []*m.CoAPMessageOption, valid *Response) []*m.CoAPMessageOption {
+	options := make([]*m.CoAPMessageOption, 0, len(cached)+1)
+	for _, option := range cached {
+		if option.Code != m.OptionMaxAge && option.Code != m.OptionEtag {
+			options = append(options, option)
+		}
+	}
+	maxAge := valid.Option(m.OptionMaxAge)
+	if maxAge == nil {
+		maxAge = m.NewOption(m.OptionMaxAge, int(defaultMaxAge/time.Second))
+	}
+	options = append(options, maxAge)
+	if etag := valid.Option(m.OptionEtag); etag != nil {
+		options = append(options, etag)
+	}
+	return options
+}
+
+// copyResponse returns a copy of a cached response the caller may modify.
+func copyResponse(resp *Response) *Response {
+	r := *resp
+	r.Body = append([]byte(nil), r.Body...)
+	r.Options = append([]*m.CoAPMessageOption(nil), r.Options...)
+	return &r
+}
@@ -1,114 +1,212 @@
 package coalago
 
 import (
+	"context"
 	"net"
 	"net/url"
+	"time"
 
 	cerr "github.com/gusleein/coalago/errors"
 	m "github.com/gusleein/coalago/message"
 )
 
-type Response struct {
-	Body          []byte
-	Code          m.CoapCode
-	PeerPublicKey []byte
-}
-
 type Client struct {
 	privateKey []byte
+	cfg        *config
+	pool       *connpool
 }
 
-func NewClient() *Client {
+func NewClient(opts ...Option) *Client {
 	c := new(Client)
+	c.cfg = newConfig(opts)
+	c.pool = globalPoolConnections
+	if c.cfg.numberConnections > 0 {
+		c.pool = newConnpool(c.cfg.numberConnections)
+	}
 	return c
 }
 
-func NewClientWithPrivateKey(pk []byte) *Client {
-	c := NewClient()
+func NewClientWithPrivateKey(pk []byte, opts ...Option) *Client {
+	c := NewClient(opts...)
 	c.privateKey = pk
 	return c
 }
 
 func (c *Client) GET(url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.GETContext(context.Background(), url, options...)
+}
+
+// GETContext is like GET but stops retransmissions and block transfers
+// as soon as ctx is done, returning ctx.Err().
+func (c *Client) GETContext(ctx context.Context, url string, options ...*m.CoAPMessageOption) (*Response, error) {
 	message, err := constructMessage(m.GET, url)
+	if err != nil {
+		return nil, err
+	}
 	message.AddOptions(options)
+	message.Context = ctx
+
+	return c.sendCached(message, message.Recipient.String())
+}
+
+// GETInto requests the resource and decodes a 2.xx response into v by its
+// Content-Format. Other response codes give cerr.UnexpectedResponseCode.
+func (c *Client) GETInto(url string, v interface{}, options ...*m.CoAPMessageOption) error {
+	return c.GETIntoContext(context.Background(), url, v, options...)
+}
 
+// GETIntoContext is like GETInto but binds the exchange to ctx.
+func (c *Client) GETIntoContext(ctx context.Context, url string, v interface{}, options ...*m.CoAPMessageOption) error {
+	resp, err := c.GETContext(ctx, url, options...)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if resp.Code.Group() != "2.xx" {
+		return cerr.UnexpectedResponseCode
 	}
-	return clientSendCONMessage(message, c.privateKey, message.Recipient.String())
+	return resp.Decode(v)
 }
 
 func (c *Client) Send(message *m.CoAPMessage, addr string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.SendContext(context.Background(), message, addr, options...)
+}
+
+// SendContext is like Send but binds the exchange to ctx.
+func (c *Client) SendContext(ctx context.Context, message *m.CoAPMessage, addr string, options ...*m.CoAPMessageOption) (*Response, error) {
 	message.AddOptions(options)
+	message.Context = ctx
+
+	return c.exchange(message, addr, nil)
+}
 
-	conn, err := globalPoolConnections.Dial(addr)
+func (c *Client) POST(data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.POSTContext(context.Background(), data, url, options...)
+}
+
+// POSTContext is like POST but binds the exchange to ctx.
+func (c *Client) POSTContext(ctx context.Context, data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	message, err := constructMessage(m.POST, url)
 	if err != nil {
 		return nil, err
 	}
+	message.AddOptions(options)
+	message.Context = ctx
 
-	defer conn.Close()
+	message.Payload = m.NewBytesPayload(data)
+	return c.sendCONMessage(message, message.Recipient.String())
+}
 
-	sr := newtransport(conn)
-	sr.privateKey = c.privateKey
+func (c *Client) PUT(data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.PUTContext(context.Background(), data, url, options...)
+}
 
-	resp, err := sr.Send(message)
-	if err != nil {
-		return nil, err
-	}
-	switch message.Type {
-	case m.NON, m.ACK:
-		return nil, nil
-	}
-	r := new(Response)
-	r.Body = resp.Payload.Bytes()
-	r.Code = resp.Code
-	r.PeerPublicKey = resp.PeerPublicKey
-	return r, nil
+// PUTContext is like PUT but binds the exchange to ctx.
+func (c *Client) PUTContext(ctx context.Context, data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.sendPayload(ctx, m.PUT, data, url, options)
 }
 
-func (c *Client) POST(data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
-	message, err := constructMessage(m.POST, url)
+// FETCH is a GET carrying a request body, e.g. a query (RFC 8132).
+func (c *Client) FETCH(data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.FETCHContext(context.Background(), data, url, options...)
+}
+
+// FETCHContext is like FETCH but binds the exchange to ctx.
+func (c *Client) FETCHContext(ctx context.Context, data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.sendPayload(ctx, m.FETCH, data, url, options)
+}
+
+// PATCH applies a partial update to the resource (RFC 8132).
+func (c *Client) PATCH(data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.PATCHContext(context.Background(), data, url, options...)
+}
+
+// PATCHContext is like PATCH but binds the exchange to ctx.
+func (c *Client) PATCHContext(ctx context.Context, data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.sendPayload(ctx, m.PATCH, data, url, options)
+}
+
+// IPATCH is an idempotent PATCH (RFC 8132).
+func (c *Client) IPATCH(data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.IPATCHContext(context.Background(), data, url, options...)
+}
+
+// IPATCHContext is like IPATCH but binds the exchange to ctx.
+func (c *Client) IPATCHContext(ctx context.Context, data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.sendPayload(ctx, m.IPATCH, data, url, options)
+}
+
+func (c *Client) sendPayload(ctx context.Context, code m.CoapCode, data []byte, url string, options []*m.CoAPMessageOption) (*Response, error) {
+	message, err := constructMessage(code, url)
 	if err != nil {
 		return nil, err
 	}
 	message.AddOptions(options)
+	message.Context = ctx
 
 	message.Payload = m.NewBytesPayload(data)
-	return clientSendCONMessage(message, c.privateKey, message.Recipient.String())
+	return c.sendCONMessage(message, message.Recipient.String())
 }
 
 func (c *Client) DELETE(data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
+	return c.DELETEContext(context.Background(), data, url, options...)
+}
+
+// DELETEContext is like DELETE but binds the exchange to ctx.
+func (c *Client) DELETEContext(ctx context.Context, data []byte, url string, options ...*m.CoAPMessageOption) (*Response, error) {
 	message, err := constructMessage(m.DELETE, url)
 	if err != nil {
 		return nil, err
 	}
 	message.AddOptions(options)
+	message.Context = ctx
+
+	return c.sendCONMessage(message, message.Recipient.String())
+}
 
-	return clientSendCONMessage(message, c.privateKey, message.Recipient.String())
+func (c *Client) sendCONMessage(message *m.CoAPMessage, addr string) (*Response, error) {
+	return c.exchange(message, addr, nil)
 }
 
-func clientSendCONMessage(message *m.CoAPMessage, privateKey []byte, addr string) (*Response, error) {
-	resp, err := clientSendCON(message, privateKey, addr)
+// exchange sends the message and wraps the reply with the metadata of the
+// exchange. Messages not expecting a reply give a nil Response.
+func (c *Client) exchange(message *m.CoAPMessage, addr string, stream *transfer) (*Response, error) {
+	conn, err := c.pool.Dial(addr)
 	if err != nil {
 		return nil, err
 	}
-	r := new(Response)
-	r.Body = resp.Payload.Bytes()
-	r.Code = resp.Code
-	r.PeerPublicKey = resp.PeerPublicKey
+
+	defer conn.Close()
+
+	sr := newtransport(conn, c.cfg)
+	sr.privateKey = c.privateKey
+	sr.transfer = stream
+
+	start := time.Now()
+	resp, err := sr.Send(message)
+	if err != nil {
+		return nil, err
+	}
+	if message.Type != m.CON {
+		return nil, nil
+	}
+
+	r := newResponse(resp)
+	r.RemoteAddr = conn.RemoteAddr()
+	r.base = &url.URL{Scheme: message.GetSchemeString(), Host: addr}
+	r.RTT = time.Since(start)
+	r.Retransmits = sr.retransmitCount()
 	return r, nil
 }
 
-func clientSendCON(message *m.CoAPMessage, privateKey []byte, addr string) (resp *m.CoAPMessage, err error) {
-	conn, err := globalPoolConnections.Dial(addr)
+func (c *Client) sendCON(message *m.CoAPMessage, addr string) (resp *m.CoAPMessage, err error) {
+	conn, err := c.pool.Dial(addr)
 	if err != nil {
 		return nil, err
 	}
 
 	defer conn.Close()
-	sr := newtransport(conn)
-	sr.privateKey = privateKey
+	sr := newtransport(conn, c.cfg)
+	sr.privateKey = c.privateKey
 
 	return sr.Send(message)
 }
@@ -160,17 +258,9 @@ func parseURI(uri string) (path, scheme string, queries url.Values, addr net.Add
 	return
 }
 
-func isBigPayload(message *m.CoAPMessage) bool {
-	if message.Payload != nil {
-		return message.Payload.Length() > MAX_PAYLOAD_SIZE
-	}
-
-	return false
-}
-
 func Ping(addr string) (isPing bool, err error) {
 	msg := m.NewCoAPMessage(m.CON, m.CoapCodeEmpty)
-	resp, err := clientSendCON(msg, nil, addr)
+	resp, err := NewClient().sendCON(msg, addr)
 	if err != nil {
 		return false, err
 	}
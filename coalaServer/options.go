@@ -0,0 +1,94 @@
+package coalaServer
+
+import "time"
+
+// Option tunes the retransmission, block-wise transfer and session
+// parameters of a Server.
+type Option func(*config)
+
+type config struct {
+	timeWait          time.Duration
+	maxSendAttempts   int
+	blockSize         int
+	windowSize        int
+	minWindowSize     int
+	maxWindowSize     int
+	sessionExpiration time.Duration
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{
+		timeWait:          timeWait,
+		maxSendAttempts:   maxSendAttempts,
+		blockSize:         MAX_PAYLOAD_SIZE,
+		windowSize:        DEFAULT_WINDOW_SIZE,
+		minWindowSize:     MIN_WiNDOW_SIZE,
+		maxWindowSize:     MAX_WINDOW_SIZE,
+		sessionExpiration: sessionLifetime,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// sumTimeAttempts is the longest time an exchange may stay unanswered.
+func (cfg *config) sumTimeAttempts() time.Duration {
+	return cfg.timeWait*time.Duration(cfg.maxSendAttempts) + 100
+}
+
+// WithTimeout sets how long to wait for an ACK before retransmitting.
+func WithTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		if d > 0 {
+			cfg.timeWait = d
+		}
+	}
+}
+
+// WithMaxRetransmit sets how many times a block is sent before the
+// transfer is abandoned.
+func WithMaxRetransmit(n int) Option {
+	return func(cfg *config) {
+		if n > 0 {
+			cfg.maxSendAttempts = n
+		}
+	}
+}
+
+// WithBlockSize sets the payload size of a single Block2 block. The value
+// is rounded down to a power of two between 16 and 1024.
+func WithBlockSize(n int) Option {
+	return func(cfg *config) {
+		if n < 16 {
+			return
+		}
+		size := 16
+		for size*2 <= n && size < MAX_PAYLOAD_SIZE {
+			size *= 2
+		}
+		cfg.blockSize = size
+	}
+}
+
+// WithWindowSize sets the initial selective repeat window and the bounds
+// the window is balanced within during a transfer.
+func WithWindowSize(initial, min, max int) Option {
+	return func(cfg *config) {
+		if min <= 0 || min > max || initial < min || initial > max {
+			return
+		}
+		cfg.windowSize = initial
+		cfg.minWindowSize = min
+		cfg.maxWindowSize = max
+	}
+}
+
+// WithSessionExpiration sets how long an idle coaps:// session is kept.
+func WithSessionExpiration(d time.Duration) Option {
+	return func(cfg *config) {
+		if d > 0 {
+			cfg.sessionExpiration = d
+		}
+	}
+}
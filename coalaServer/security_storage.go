@@ -24,9 +24,9 @@ type securitySessionStorage struct {
 	seccache *cache.Cache
 }
 
-func newSecuritySessionStorage() *securitySessionStorage {
+func newSecuritySessionStorage(expiration time.Duration) *securitySessionStorage {
 	s := &securitySessionStorage{
-		seccache: cache.New(sessionLifetime, time.Second),
+		seccache: cache.New(expiration, time.Second),
 	}
 
 	return s
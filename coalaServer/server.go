@@ -1,6 +1,8 @@
 package coalaServer
 
 import (
+	"fmt"
+	"io/ioutil"
 	"math"
 	"net"
 	"sync"
@@ -9,38 +11,47 @@ import (
 	m "github.com/gusleein/coalago/message"
 	r "github.com/gusleein/coalago/resource"
 	"github.com/gusleein/coalago/util"
+	log "github.com/ndmsystems/golog"
 )
 
 type Server struct {
 	privateKey []byte
 
-	postResources   map[string]r.CoAPResourceHandler
-	getResources    map[string]r.CoAPResourceHandler
-	deleteResources map[string]r.CoAPResourceHandler
+	router *r.Router
+
+	middlewaresMX sync.RWMutex
+	middlewares   []r.Middleware
 
 	block2sendsMX sync.RWMutex
 	block2sends   map[string]chan *m.CoAPMessage
 
 	block1receiveMX sync.RWMutex
 	block1receive   map[string]chan *m.CoAPMessage
+	// block1streams are the transfers of block1receive feeding a stream
+	// handler, whose blocks are dropped rather than queued while the
+	// handler is behind
+	block1streams map[string]bool
 
 	inProcessMX sync.RWMutex
 	inProcess   map[string]struct{}
 
 	secSessions *securitySessionStorage
+
+	cfg *config
 }
 
-func NewServer(pk []byte) *Server {
+func NewServer(pk []byte, opts ...Option) *Server {
 	s := new(Server)
-	s.postResources = make(map[string]r.CoAPResourceHandler)
-	s.getResources = make(map[string]r.CoAPResourceHandler)
-	s.deleteResources = make(map[string]r.CoAPResourceHandler)
+	s.cfg = newConfig(opts)
+	s.router = r.NewRouter()
+	s.router.Add(r.NewCoAPResource(m.CoapMethodGet, r.WellKnownCore, r.NewDiscoveryHandler(s.router)))
 
 	s.block2sends = make(map[string]chan *m.CoAPMessage)
 	s.block1receive = make(map[string]chan *m.CoAPMessage)
+	s.block1streams = make(map[string]bool)
 
 	s.inProcess = make(map[string]struct{})
-	s.secSessions = newSecuritySessionStorage()
+	s.secSessions = newSecuritySessionStorage(s.cfg.sessionExpiration)
 
 	s.privateKey = pk
 	return s
@@ -69,17 +80,51 @@ func (s *Server) Listen(addr string) (err error) {
 	}
 }
 
-func (s *Server) GET(path string, handler r.CoAPResourceHandler) {
-	s.getResources[path] = handler
+func (s *Server) GET(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.router.Add(r.NewCoAPResource(m.CoapMethodGet, path, handler, middlewares...))
+}
+
+func (s *Server) POST(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.router.Add(r.NewCoAPResource(m.CoapMethodPost, path, handler, middlewares...))
+}
+
+func (s *Server) PUT(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.router.Add(r.NewCoAPResource(m.CoapMethodPut, path, handler, middlewares...))
+}
+
+// POSTStream registers a POST resource reading block-wise requests as they
+// arrive, see r.CoAPResourceStreamHandler.
+func (s *Server) POSTStream(path string, handler r.CoAPResourceStreamHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.router.Add(r.NewCoAPStreamResource(m.CoapMethodPost, path, handler, middlewares...))
+}
+
+// PUTStream is like POSTStream for PUT.
+func (s *Server) PUTStream(path string, handler r.CoAPResourceStreamHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.router.Add(r.NewCoAPStreamResource(m.CoapMethodPut, path, handler, middlewares...))
 }
 
-func (s *Server) POST(path string, handler r.CoAPResourceHandler) {
-	s.postResources[path] = handler
+func (s *Server) DELETE(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.router.Add(r.NewCoAPResource(m.CoapMethodDelete, path, handler, middlewares...))
+}
 
+func (s *Server) FETCH(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.router.Add(r.NewCoAPResource(m.CoapMethodFetch, path, handler, middlewares...))
 }
 
-func (s *Server) DELETE(path string, handler r.CoAPResourceHandler) {
-	s.deleteResources[path] = handler
+func (s *Server) PATCH(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.router.Add(r.NewCoAPResource(m.CoapMethodPatch, path, handler, middlewares...))
+}
+
+func (s *Server) IPATCH(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.router.Add(r.NewCoAPResource(m.CoapMethodIPatch, path, handler, middlewares...))
+}
+
+// Use appends middlewares wrapping the handlers of all resources, outside
+// of the middlewares given to a single resource.
+func (s *Server) Use(middlewares ...r.Middleware) {
+	s.middlewaresMX.Lock()
+	s.middlewares = append(s.middlewares, middlewares...)
+	s.middlewaresMX.Unlock()
 }
 
 func buildMsg(addr net.Addr, buf []byte) (*m.CoAPMessage, error) {
@@ -105,9 +150,24 @@ func (s *Server) serve(pc net.PacketConn, msg *m.CoAPMessage) {
 			ch, ok := s.block1receive[msg.GetTokenString()]
 
 			if !ok {
-				ch = make(chan *m.CoAPMessage, 1)
+				if res, ok := s.streams(msg); ok {
+					ch = make(chan *m.CoAPMessage, s.cfg.windowSize)
+					s.block1streams[msg.GetTokenString()] = true
+					go s.receiveBlock1Stream(pc, msg, res, ch)
+				} else {
+					ch = make(chan *m.CoAPMessage, 1)
+					go s.receiveARQBlock1(pc, msg, ch)
+				}
 				s.block1receive[msg.GetTokenString()] = ch
-				go s.receiveARQBlock1(pc, msg, ch)
+			}
+			if s.block1streams[msg.GetTokenString()] {
+				select {
+				case ch <- msg:
+				default:
+					// not acknowledged, the block comes again
+				}
+				s.block1receiveMX.Unlock()
+				return
 			}
 			s.block1receiveMX.Unlock()
 
@@ -123,6 +183,14 @@ func (s *Server) serve(pc net.PacketConn, msg *m.CoAPMessage) {
 
 func (s *Server) serveCON(pc net.PacketConn, msg *m.CoAPMessage) {
 	if res, ok := s.getResource(msg); ok {
+		handler, mediaType, code := res.Negotiate(msg)
+		if code != 0 {
+			if msg.Type == m.CON {
+				s.rejectWithCode(pc, msg, code)
+			}
+			return
+		}
+
 		s.inProcessMX.Lock()
 
 		_, ok := s.inProcess[msg.GetTokenString()]
@@ -135,12 +203,48 @@ func (s *Server) serveCON(pc net.PacketConn, msg *m.CoAPMessage) {
 		s.inProcessMX.Unlock()
 
 		go func() {
-			s.resourceProcessor(pc, msg, res)
+			s.resourceProcessor(pc, msg, res, s.withMiddlewares(handler), mediaType)
 			s.deleteInProcess(msg.GetTokenString())
 		}()
+	} else if msg.Type == m.CON {
+		s.rejectRequest(pc, msg)
 	}
 }
 
+// rejectRequest answers a confirmable message no resource is going to
+// handle: 4.05 with the allowed methods if the path exists or the method
+// is unknown, 4.04 if the path does not exist and RST if the message is
+// not a request at all.
+func (s *Server) rejectRequest(pc net.PacketConn, msg *m.CoAPMessage) {
+	if !msg.Code.IsRequest() {
+		responseMessage := m.NewCoAPMessageId(m.RST, m.CoapCodeEmpty, msg.MessageID)
+		responseMessage.Token = msg.Token
+		s.send(pc, responseMessage, msg.Sender)
+		return
+	}
+
+	var responseMessage *m.CoAPMessage
+	if methods := s.router.Methods(msg.GetURIPath()); len(methods) > 0 || !msg.Code.IsRegisteredMethod() {
+		responseMessage = m.NewCoAPMessageId(m.ACK, m.CoapCodeMethodNotAllowed, msg.MessageID)
+		responseMessage.Payload = m.NewStringPayload(m.MethodsString(methods))
+	} else {
+		responseMessage = m.NewCoAPMessageId(m.ACK, m.CoapCodeNotFound, msg.MessageID)
+		responseMessage.Payload = m.NewStringPayload("Requested resource " + msg.GetURIPath() + " does not exist")
+	}
+	responseMessage.Token = msg.Token
+	if msg.GetScheme() == m.COAPS_SCHEME {
+		responseMessage.SetSchemeCOAPS()
+	}
+	responseMessage.CloneOptions(msg, m.OptionBlock1, m.OptionBlock2, m.OptionProxySecurityID)
+
+	s.send(pc, responseMessage, msg.Sender)
+}
+
+// rejectWithCode answers code without payload, see r.EmptyResponse.
+func (s *Server) rejectWithCode(pc net.PacketConn, msg *m.CoAPMessage, code m.CoapCode) {
+	s.send(pc, r.EmptyResponse(msg, code), msg.Sender)
+}
+
 func (s *Server) serveACK(pc net.PacketConn, msg *m.CoAPMessage) {
 	if block := msg.GetBlock2(); block != nil {
 		s.block2sendsMX.RLock()
@@ -152,53 +256,71 @@ func (s *Server) serveACK(pc net.PacketConn, msg *m.CoAPMessage) {
 	}
 }
 
-func (s *Server) getResource(msg *m.CoAPMessage) (res r.CoAPResourceHandler, ok bool) {
-	path := msg.GetURIPath()
+func (s *Server) getResource(msg *m.CoAPMessage) (res *r.CoAPResource, ok bool) {
 	switch msg.Code {
-	case m.POST:
-		res, ok = s.postResources[path]
-	case m.GET:
-		res, ok = s.getResources[path]
-	case m.DELETE:
-		res, ok = s.deleteResources[path]
+	case m.POST, m.GET, m.PUT, m.DELETE, m.FETCH, m.PATCH, m.IPATCH:
+		resource, params := s.router.Match(msg.GetURIPath(), msg.GetMethod())
+		if resource == nil {
+			return nil, false
+		}
+		msg.PathParams = params
+		return resource, true
 	}
 	return
 }
 
-func (s *Server) resourceProcessor(pc net.PacketConn, msg *m.CoAPMessage, res r.CoAPResourceHandler) {
-	result := res(msg)
-	if msg.Type == m.NON {
+func (s *Server) withMiddlewares(handler r.CoAPResourceHandler) r.CoAPResourceHandler {
+	s.middlewaresMX.RLock()
+	defer s.middlewaresMX.RUnlock()
+	return r.Chain(handler, s.middlewares...)
+}
+
+func (s *Server) resourceProcessor(pc net.PacketConn, msg *m.CoAPMessage, res *r.CoAPResource, handler r.CoAPResourceHandler, mediaType m.MediaType) {
+	if res.PreconditionsFailed(msg) {
+		if msg.Type == m.CON {
+			s.rejectWithCode(pc, msg, m.CoapCodePreconditionFailed)
+		}
 		return
 	}
 
-	// Create ACK response with the same ID and given reponse Code
-	responseMessage := m.NewCoAPMessageId(m.ACK, result.Code, msg.MessageID)
-	if result.Payload != nil {
-		responseMessage.Payload = result.Payload
-	} else {
-		responseMessage.Payload = m.NewEmptyPayload()
+	result, panicked := r.Call(handler, msg)
+	if !panicked {
+		var err error
+		if result, err = res.Render(result, mediaType); err != nil {
+			log.Error(fmt.Sprintf("COALA render %s %s: %v", msg.Code.String(), msg.GetURIPath(), err))
+			panicked = true
+		}
+		result = r.Validate(msg, result)
 	}
-
-	// Replicate Token of the original message if any
-	responseMessage.Token = msg.Token
-
-	// Setup additional Content Format description if necessary
-	if result.MediaType >= 0 {
-		responseMessage.AddOption(m.OptionContentFormat, result.MediaType)
+	// the body of the result, if any, is read while sending the response
+	defer result.Close()
+	if msg.Type == m.NON {
+		return
+	}
+	if panicked {
+		result = r.NewResponse(m.NewStringPayload("Resource handler failed"), m.CoapCodeInternalServerError)
+	} else if result == nil {
+		result = r.NewResponse(m.NewStringPayload("No Result was returned by Resource Handler"), m.CoapCodeInternalServerError)
 	}
 
+	responseMessage := r.ResponseMessage(msg, result)
+
 	// validate Observe option (add Option in Response upon registration!)
 	if option := msg.GetOption(m.OptionObserve); option != nil && option.IntValue() == 0 {
 		responseMessage.AddOption(m.OptionObserve, 1)
 	}
 
-	// Validate message scheme
-	if msg.GetScheme() == m.COAPS_SCHEME {
-		responseMessage.SetSchemeCOAPS()
+	if responseMessage.Body != nil && result.Size <= int64(s.cfg.blockSize) {
+		// the body fits into the message
+		payload, err := ioutil.ReadAll(responseMessage.Body)
+		if err != nil {
+			log.Error(fmt.Sprintf("COALA read body %s %s: %v", msg.Code.String(), msg.GetURIPath(), err))
+			return
+		}
+		responseMessage.Payload = m.NewBytesPayload(payload)
+		responseMessage.Body = nil
 	}
-
-	responseMessage.CloneOptions(msg, m.OptionBlock1, m.OptionBlock2, m.OptionSelectiveRepeatWindowSize, m.OptionProxySecurityID)
-	if responseMessage.Payload.Length() > MAX_PAYLOAD_SIZE {
+	if responseMessage.Body != nil || responseMessage.Payload.Length() > s.cfg.blockSize {
 		s.sendBlock2Response(pc, responseMessage, msg.Sender)
 	} else {
 		s.send(pc, responseMessage, msg.Sender)
@@ -232,35 +354,38 @@ func (s *Server) sendBlock2Response(pc net.PacketConn, sendsMessage *m.CoAPMessa
 		s.block2sendsMX.Unlock()
 	}()
 
-	packets := []*packet{}
-	state := makeState(sendsMessage)
+	state := s.makeState(sendsMessage)
 
 	emptyAckMessage := m.NewACKEmptyMessage(sendsMessage, state.Windowsize)
 	if err := s.send(pc, emptyAckMessage, addr); err != nil {
 		return
 	}
 
-	for {
-		blockMessage, end := m.ConstructNextBlock(m.OptionBlock2, state)
-		packets = append(packets, &packet{
-			acked:   false,
-			message: blockMessage,
-		})
-
-		if end {
-			break
+	// blocks are built as the window reaches them and dropped once
+	// acknowledged
+	packets := make([]*packet, int(math.Ceil(float64(state.Lenght)/float64(s.cfg.blockSize))))
+	ackedPacket := &packet{acked: true}
+	next := func() (*m.CoAPMessage, error) {
+		blockMessage, _ := m.ConstructNextBlock(m.OptionBlock2, state)
+		return blockMessage, nil
+	}
+	if sendsMessage.Body != nil {
+		next = func() (*m.CoAPMessage, error) {
+			blockMessage, _, err := m.ReadNextBlock(m.OptionBlock2, state, sendsMessage.Body)
+			return blockMessage, err
 		}
 	}
 
 	shift := 0
+	acked, retransmits, retransmitsTmp := 0, 0, 0
 
-	if err := s.sendPacketsToAddr(pc, packets, state.Windowsize, shift, addr); err != nil {
+	if err := s.sendPacketsToAddr(pc, packets, next, state.Windowsize, shift, &retransmits, addr); err != nil {
 		return
 	}
 
 	for {
 		select {
-		case <-time.After(sumTimeAttempts):
+		case <-time.After(s.cfg.sumTimeAttempts()):
 			return
 		case resp := <-ch:
 			block := resp.GetBlock2()
@@ -276,7 +401,25 @@ func (s *Server) sendBlock2Response(pc net.PacketConn, sendsMessage *m.CoAPMessa
 				continue
 			}
 
-			packets[block.BlockNumber].acked = true
+			if packets[block.BlockNumber] == nil || packets[block.BlockNumber].acked {
+				continue
+			}
+			packets[block.BlockNumber] = ackedPacket
+
+			// the window grows while blocks get through and shrinks
+			// when they have to be sent again, like the client's
+			acked++
+			if acked%25 == 0 {
+				state.Windowsize += int(float64(2-retransmits+retransmitsTmp) * 0.7)
+				retransmitsTmp = retransmits
+				if state.Windowsize < s.cfg.minWindowSize {
+					state.Windowsize = s.cfg.minWindowSize
+				}
+				if state.Windowsize > s.cfg.maxWindowSize {
+					state.Windowsize = s.cfg.maxWindowSize
+				}
+			}
+
 			if block.BlockNumber != shift {
 				continue
 			}
@@ -284,31 +427,35 @@ func (s *Server) sendBlock2Response(pc net.PacketConn, sendsMessage *m.CoAPMessa
 			shift++
 
 			for _, p := range packets[shift:] {
-				if p.acked {
+				if p != nil && p.acked {
 					shift++
 				} else {
 					break
 				}
 			}
 
-			if err := s.sendPacketsToAddr(pc, packets, state.Windowsize, shift, addr); err != nil {
+			if err := s.sendPacketsToAddr(pc, packets, next, state.Windowsize, shift, &retransmits, addr); err != nil {
 				return
 			}
 		}
 	}
 }
 
-func makeState(msg *m.CoAPMessage) *m.StateSend {
+func (s *Server) makeState(msg *m.CoAPMessage) *m.StateSend {
 	state := new(m.StateSend)
-	state.Payload = msg.Payload.Bytes()
-	state.Lenght = len(state.Payload)
+	if msg.Body != nil {
+		state.Lenght = msg.GetOption(m.OptionSize2).IntValue()
+	} else {
+		state.Payload = msg.Payload.Bytes()
+		state.Lenght = len(state.Payload)
+	}
 	state.OrigMessage = msg
-	state.BlockSize = MAX_PAYLOAD_SIZE
-	numblocks := math.Ceil(float64(state.Lenght) / float64(MAX_PAYLOAD_SIZE))
-	if numblocks < DEFAULT_WINDOW_SIZE {
+	state.BlockSize = s.cfg.blockSize
+	numblocks := math.Ceil(float64(state.Lenght) / float64(s.cfg.blockSize))
+	if int(numblocks) < s.cfg.windowSize {
 		state.Windowsize = int(numblocks)
 	} else {
-		state.Windowsize = DEFAULT_WINDOW_SIZE
+		state.Windowsize = s.cfg.windowSize
 	}
 
 	return state
@@ -330,6 +477,7 @@ func (s *Server) send(pc net.PacketConn, msg *m.CoAPMessage, addr net.Addr) erro
 func (s *Server) deleteBlock1Receive(token string, c chan *m.CoAPMessage) {
 	s.block1receiveMX.Lock()
 	delete(s.block1receive, token)
+	delete(s.block1streams, token)
 	close(c)
 	s.block1receiveMX.Unlock()
 }
@@ -377,7 +525,7 @@ func (s *Server) receiveARQBlock1(pc net.PacketConn, msg *m.CoAPMessage, input c
 				return
 			}
 
-		case <-time.After(sumTimeAttempts):
+		case <-time.After(s.cfg.sumTimeAttempts()):
 			s.deleteBlock1Receive(msg.GetTokenString(), input)
 			return
 		}
@@ -0,0 +1,88 @@
+package coalaServer
+
+import (
+	"io"
+	"net"
+	"time"
+
+	cerr "github.com/gusleein/coalago/errors"
+	m "github.com/gusleein/coalago/message"
+	r "github.com/gusleein/coalago/resource"
+	"github.com/gusleein/coalago/util"
+)
+
+// streams reports whether msg is the first block of a request to a stream
+// resource. A request whose first block came late is reassembled.
+func (s *Server) streams(msg *m.CoAPMessage) (*r.CoAPResource, bool) {
+	block := msg.GetBlock1()
+	if msg.Type != m.CON || block == nil || block.BlockNumber != 0 || !block.MoreBlocks {
+		return nil, false
+	}
+	res, ok := s.getResource(msg)
+	return res, ok && res.Streams()
+}
+
+// receiveBlock1Stream runs the handler of res as soon as the first block of
+// a request arrives and feeds it the blocks in order through the Body of
+// the request. A block is acknowledged only once it is written or waits
+// within the window, so that a handler falling behind holds the sender back.
+func (s *Server) receiveBlock1Stream(pc net.PacketConn, msg *m.CoAPMessage, res *r.CoAPResource, input chan *m.CoAPMessage) {
+	token := msg.GetTokenString()
+
+	pr, pw := io.Pipe()
+	request := *msg
+	request.Options = append([]*m.CoAPMessageOption(nil), msg.Options...)
+	request.Payload = m.NewEmptyPayload()
+	request.Body = pr
+
+	go func() {
+		if handler, mediaType, code := res.Negotiate(&request); code != 0 {
+			s.rejectWithCode(pc, &request, code)
+		} else {
+			s.resourceProcessor(pc, &request, res, s.withMiddlewares(handler), mediaType)
+		}
+		pr.Close()
+	}()
+
+	blocks := util.NewBlockWriter(pw, nil)
+	for {
+		select {
+		case inputMessage := <-input:
+			block := inputMessage.GetBlock1()
+			if block == nil || inputMessage.Type != m.CON {
+				continue
+			}
+
+			stored, err := blocks.Put(block.BlockNumber, inputMessage.Payload.Bytes(), block.MoreBlocks, s.cfg.maxWindowSize)
+			if err != nil {
+				// the request was answered without reading it through
+				s.deleteBlock1Receive(token, input)
+				return
+			}
+			if !stored {
+				continue
+			}
+
+			if blocks.Done() {
+				// the response is the ACK of the block completing the request
+				request.MessageID = inputMessage.MessageID
+				request.RemoveOptions(m.OptionBlock1)
+				request.CloneOptions(inputMessage, m.OptionBlock1)
+				pw.Close()
+				s.deleteBlock1Receive(token, input)
+				return
+			}
+
+			if err := s.send(pc, m.AckTo(nil, inputMessage, m.CoapCodeContinue), inputMessage.Sender); err != nil {
+				pw.CloseWithError(err)
+				s.deleteBlock1Receive(token, input)
+				return
+			}
+
+		case <-time.After(s.cfg.sumTimeAttempts()):
+			pw.CloseWithError(cerr.MaxAttempts)
+			s.deleteBlock1Receive(token, input)
+			return
+		}
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"time"
 
 	cerr "github.com/gusleein/coalago/errors"
+	m "github.com/gusleein/coalago/message"
 	"github.com/gusleein/coalago/util"
 )
 
-func (s *Server) sendPacketsToAddr(pc net.PacketConn, packets []*packet, windowsize int, shift int, addr net.Addr) error {
+// sendPacketsToAddr (re)sends the packets of the window whose ACK is
+// overdue. A nil packet has not been built yet and is made by next.
+func (s *Server) sendPacketsToAddr(pc net.PacketConn, packets []*packet, next func() (*m.CoAPMessage, error), windowsize int, shift int, retransmits *int, addr net.Addr) error {
 	stop := shift + windowsize
 	if stop >= len(packets) {
 		stop = len(packets)
@@ -19,26 +22,32 @@ func (s *Server) sendPacketsToAddr(pc net.PacketConn, packets []*packet, windows
 	}
 
 	for i := 0; i < stop; i++ {
+		if packets[i] == nil {
+			blockMessage, err := next()
+			if err != nil {
+				return err
+			}
+			packets[i] = &packet{message: blockMessage}
+		}
 		if packets[i].acked {
 			continue
 		}
 
-		if time.Since(packets[i].lastSend) < timeWait {
+		if time.Since(packets[i].lastSend) < s.cfg.timeWait {
 			continue
 		}
 
-		if packets[i].attempts == maxSendAttempts {
+		if packets[i].attempts == s.cfg.maxSendAttempts {
 			util.MetricExpiredMessages.Inc()
 			return cerr.MaxAttempts
 		}
 		packets[i].attempts++
 		if packets[i].attempts > 1 {
 			util.MetricRetransmitMessages.Inc()
+			*retransmits++
 		}
 		packets[i].lastSend = time.Now()
-		m := packets[i].message
-
-		if err := s.send(pc, m, addr); err != nil {
+		if err := s.send(pc, packets[i].message, addr); err != nil {
 			return err
 		}
 
@@ -9,7 +9,7 @@ import (
 	m "github.com/gusleein/coalago/message"
 )
 
-var globalPoolConnections = newConnpool()
+var globalPoolConnections = newConnpool(NumberConnections)
 
 type dialer interface {
 	Close() error
@@ -53,7 +53,9 @@ func (c *connection) SetUDPRecvBuf(size int) int {
 
 func (c *connection) Close() error {
 	err := c.conn.Close()
-	<-c.end
+	if c.end != nil {
+		<-c.end
+	}
 	return err
 }
 
@@ -147,9 +149,9 @@ func newListenerV6(addr string) (dialer, error) {
 	return c, nil
 }
 
-func newConnpool() *connpool {
+func newConnpool(size int) *connpool {
 	c := new(connpool)
-	c.balance = make(chan struct{}, NumberConnections)
+	c.balance = make(chan struct{}, size)
 	return c
 }
 
@@ -166,14 +168,23 @@ func (c *connection) SetReadDeadlineSec(timeout time.Duration) {
 }
 
 func receiveMessage(tr *transport, origMessage *m.CoAPMessage) (*m.CoAPMessage, error) {
+	ctx := messageContext(origMessage)
 	for {
 		tr.conn.SetReadDeadlineSec(origMessage.Timeout)
+		// checked after the deadline is armed so that a cancellation racing
+		// with it is never lost, see transport.watchContext
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
 		buff := make([]byte, MTU+1)
 		n, err := tr.conn.Read(buff)
-		origMessage.Timeout = timeWait
+		origMessage.Timeout = tr.cfg.timeWait
 		if err != nil {
 			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
 				return nil, cerr.MaxAttempts
 			}
 			return nil, err
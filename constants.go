@@ -17,6 +17,9 @@ const (
 	MIN_WiNDOW_SIZE          = 50
 	MAX_WINDOW_SIZE          = 1500
 	MTU                      = 1500
+
+	// EXCHANGE_LIFETIME of RFC 7252, section 4.8.2
+	SEPARATE_RESPONSE_TIMEOUT = 247 * time.Second
 )
 
 var NumberConnections = 1024
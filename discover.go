@@ -0,0 +1,41 @@
+package coalago
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	cerr "github.com/gusleein/coalago/errors"
+	m "github.com/gusleein/coalago/message"
+	r "github.com/gusleein/coalago/resource"
+)
+
+// Discover fetches the resources the server at addr lists at
+// /.well-known/core (RFC 6690). The addr is either host:port or a URL such
+// as coaps://host:port?rt=temperature to choose the scheme and filter
+// the links.
+func (c *Client) Discover(addr string) ([]r.Link, error) {
+	return c.DiscoverContext(context.Background(), addr)
+}
+
+// DiscoverContext is like Discover but binds the exchange to ctx.
+func (c *Client) DiscoverContext(ctx context.Context, addr string) ([]r.Link, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "coap://" + addr
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + r.WellKnownCore
+
+	resp, err := c.GETContext(ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != m.CoapCodeContent {
+		return nil, cerr.UnexpectedResponseCode
+	}
+	return r.ParseLinks(string(resp.Body))
+}
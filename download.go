@@ -0,0 +1,63 @@
+package coalago
+
+import (
+	"context"
+	"io"
+
+	cerr "github.com/gusleein/coalago/errors"
+	m "github.com/gusleein/coalago/message"
+)
+
+// ProgressFunc is called as a transfer goes on with the number of bytes
+// done so far and the total, -1 if it is unknown.
+type ProgressFunc func(done, total int64)
+
+// transfer streams the bodies of an exchange.
+type transfer struct {
+	body io.Reader // request body of size bytes, sent in Block1
+	size int64
+
+	output   io.Writer // response body received in Block2
+	progress ProgressFunc
+
+	// resuming, see Transfer
+	first     int    // number of the block to go on from
+	offset    int64  // bytes acknowledged or written in a row from the start
+	blockSize int    // size of the blocks received
+	etag      []byte // ETag the blocks received must have, if not nil
+}
+
+// Download writes the representation at url to w as its blocks arrive
+// instead of collecting it in memory, keeping at most a window of blocks
+// that came out of order. progress, if not nil, is called after every write.
+// The returned Response has no Body. A response other than 2.xx comes with
+// cerr.UnexpectedResponseCode and its body is not written to w.
+func (c *Client) Download(ctx context.Context, url string, w io.Writer, progress ProgressFunc, options ...*m.CoAPMessageOption) (*Response, error) {
+	message, err := constructMessage(m.GET, url)
+	if err != nil {
+		return nil, err
+	}
+	message.AddOptions(options)
+	message.Context = ctx
+
+	resp, err := c.exchange(message, message.Recipient.String(), &transfer{output: w, progress: progress})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code.Group() != "2.xx" {
+		return resp, cerr.UnexpectedResponseCode
+	}
+
+	// a response fitting into a single message is not streamed
+	if len(resp.Body) > 0 {
+		if _, err = w.Write(resp.Body); err != nil {
+			return nil, err
+		}
+		if progress != nil {
+			total := int64(len(resp.Body))
+			progress(total, total)
+		}
+		resp.Body = nil
+	}
+	return resp, nil
+}
@@ -27,5 +27,9 @@ var (
 	OptionLenghtOutOfRangePackets = errors.New("Option lenght out of range packet")
 	UndefinedScheme               = errors.New("Undefined scheme")
 	UnsupportedType               = errors.New("Unsuported type")
+	ServerClosed                  = errors.New("server closed")
+	InvalidLinkFormat             = errors.New("invalid link format")
+	UnexpectedResponseCode        = errors.New("unexpected response code")
+	TransferChanged               = errors.New("transfer changed")
 	ERR_KEYS_NOT_MATCH            = "Expected and current public keys do not match"
 )
@@ -3,6 +3,7 @@ module github.com/gusleein/coalago
 go 1.14
 
 require (
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/lucas-clemente/aes12 v0.0.0-20171027163421-cd47fb39b79f
 	github.com/ndmsystems/golog v0.0.0-20221012082214-cd4daa77d67a
 	github.com/onsi/ginkgo v1.14.2
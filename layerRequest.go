@@ -1,39 +1,76 @@
 package coalago
 
 import (
+	"fmt"
+
 	m "github.com/gusleein/coalago/message"
 	r "github.com/gusleein/coalago/resource"
+	log "github.com/ndmsystems/golog"
 )
 
-func requestOnReceive(resource *r.CoAPResource, sr *transport, message *m.CoAPMessage) bool {
-	if message.Code < 0 || message.Code > 4 {
-		return true
+func requestOnReceive(rs Resourcer, sr *transport, message *m.CoAPMessage) bool {
+	if message.Code > m.IPATCH {
+		return unsupportedCode(rs, sr, message)
 	}
 
 	if isPing(message) {
 		return returnPing(sr, message)
 	}
 
+	resource, params := rs.getResourceForPathAndMethod(message.GetURIPath(), message.GetMethod())
+	message.PathParams = params
+
 	if resource == nil {
 		if message.Type == m.CON {
+			if methods := rs.getMethodsForPath(message.GetURIPath()); len(methods) > 0 {
+				return methodNotAllowed(sr, message, methods)
+			}
 			return noResource(sr, message)
 		}
 		return false
 	}
 
-	if resource.Method != message.GetMethod() {
-		return methodNotAllowed(sr, message)
+	handler, mediaType, code := resource.Negotiate(message)
+	if code == 0 && resource.PreconditionsFailed(message) {
+		code = m.CoapCodePreconditionFailed
+	}
+	if code != 0 {
+		if message.Type == m.CON {
+			return requestFailed(sr, message, code)
+		}
+		return false
+	}
+
+	handlerResult, panicked, separated := callHandlerSeparately(sr, rs.withMiddlewares(handler), message)
+	if !panicked {
+		var err error
+		if handlerResult, err = resource.Render(handlerResult, mediaType); err != nil {
+			log.Error(fmt.Sprintf("COALA render %s %s: %v", message.Code.String(), message.GetURIPath(), err))
+			panicked = true
+		}
+		handlerResult = r.Validate(message, handlerResult)
+	}
+	// the body of the result, if any, is read while sending the response
+	defer handlerResult.Close()
+	if separated {
+		return returnSeparateResult(rs, sr, message, handlerResult, panicked)
+	}
+	if panicked {
+		if message.Type == m.CON {
+			return internalServerError(sr, message, "Resource handler failed")
+		}
+		return false
 	}
 
-	if handlerResult := resource.Handler(message); handlerResult != nil {
+	if handlerResult != nil {
 		if message.Type == m.NON {
 			return false
 		}
-		return returnResultFromResource(sr, message, handlerResult)
+		return returnResultFromResource(rs, sr, message, handlerResult)
 	}
 
 	if message.Type == m.CON {
-		return noResultResourceHandler(sr, message)
+		return noResultResourceHandler(rs, sr, message)
 	}
 	return false
 }
@@ -51,58 +88,78 @@ func returnPing(sr *transport, message *m.CoAPMessage) bool {
 	return err != nil
 }
 
-func methodNotAllowed(sr *transport, message *m.CoAPMessage) bool {
+// methodNotAllowed answers 4.05 with the methods registered for the path,
+// e.g. "GET, PUT", as the payload.
+func methodNotAllowed(sr *transport, message *m.CoAPMessage, allowed []m.CoapMethod) bool {
 	responseMessage := m.NewCoAPMessageId(m.ACK, m.CoapCodeMethodNotAllowed, message.MessageID)
-	responseMessage.Payload = m.NewStringPayload("Method is not allowed for requested resource")
+	responseMessage.Payload = m.NewStringPayload(m.MethodsString(allowed))
 	if message.Token != nil && len(message.Token) > 0 {
 		responseMessage.Token = message.Token
 	}
+	if message.GetScheme() == m.COAPS_SCHEME {
+		responseMessage.SetSchemeCOAPS()
+	}
 	responseMessage.CloneOptions(message, m.OptionBlock1, m.OptionBlock2, m.OptionProxySecurityID)
-	sr.SendTo(responseMessage, message.Sender)
-	return false
-}
 
-func returnResultFromResource(sr *transport, message *m.CoAPMessage, handlerResult *r.CoAPResourceHandlerResult) bool {
-	// @TODO: Validate Response code! handlerResult.Code
+	_, err := sr.SendTo(responseMessage, message.Sender)
+	return err != nil
+}
 
-	// Create ACK response with the same ID and given reponse Code
-	responseMessage := m.NewCoAPMessageId(m.ACK, handlerResult.Code, message.MessageID)
-	responseMessage.Payload = handlerResult.Payload
+// unsupportedCode answers a request with a method code the server does not
+// know with 4.05 (RFC 7252, section 5.8) and rejects any other confirmable
+// message that is not a request.
+func unsupportedCode(rs Resourcer, sr *transport, message *m.CoAPMessage) bool {
+	if message.Type != m.CON {
+		return false
+	}
+	if message.Code.IsRequest() {
+		return methodNotAllowed(sr, message, rs.getMethodsForPath(message.GetURIPath()))
+	}
 
-	// Replicate Token of the original message if any
+	responseMessage := m.NewCoAPMessageId(m.RST, m.CoapCodeEmpty, message.MessageID)
 	responseMessage.Token = message.Token
+	_, err := sr.SendTo(responseMessage, message.Sender)
+	return err != nil
+}
 
-	// Setup additional Content Format description if necessary
-	if handlerResult.MediaType >= 0 {
-		responseMessage.AddOption(m.OptionContentFormat, handlerResult.MediaType)
-	}
+func returnResultFromResource(rs Resourcer, sr *transport, message *m.CoAPMessage, handlerResult *r.CoAPResourceHandlerResult) bool {
+	responseMessage := r.ResponseMessage(message, handlerResult)
 
 	// validate Observe option (add Option in Response upon registration!)
-	if option := message.GetOption(m.OptionObserve); option != nil && option.IntValue() == 0 {
-		responseMessage.AddOption(m.OptionObserve, 1)
+	if seq, ok := rs.observe(message, handlerResult.Code); ok {
+		responseMessage.AddOption(m.OptionObserve, seq)
+	}
+
+	_, err := sr.SendTo(responseMessage, message.Sender)
+	return err != nil
+}
+
+func noResultResourceHandler(rs Resourcer, sr *transport, message *m.CoAPMessage) bool {
+	if rs.nilResultPolicy() == NilResultSeparateResponse {
+		return emptyACK(sr, message)
 	}
+	return internalServerError(sr, message, "No Result was returned by Resource Handler")
+}
 
-	// Validate message scheme
+func internalServerError(sr *transport, message *m.CoAPMessage, reason string) bool {
+	responseMessage := m.NewCoAPMessageId(m.ACK, m.CoapCodeInternalServerError, message.MessageID)
+	responseMessage.Payload = m.NewStringPayload(reason)
+	if message.Token != nil && len(message.Token) > 0 {
+		responseMessage.Token = message.Token
+	}
 	if message.GetScheme() == m.COAPS_SCHEME {
 		responseMessage.SetSchemeCOAPS()
 	}
-	responseMessage.CloneOptions(message, m.OptionBlock1, m.OptionBlock2, m.OptionSelectiveRepeatWindowSize, m.OptionProxySecurityID)
+	responseMessage.CloneOptions(message, m.OptionBlock1, m.OptionBlock2, m.OptionProxySecurityID)
 
 	_, err := sr.SendTo(responseMessage, message.Sender)
 	return err != nil
 }
 
-func noResultResourceHandler(sr *transport, message *m.CoAPMessage) bool {
-	// responseMessage := NewCoAPMessageId(ACK, CoapCodeInternalServerError, message.MessageID)
-	// responseMessage.Payload = NewStringPayload("No Result was returned by Resource Handler")
-	// if message.Token != nil && len(message.Token) > 0 {
-	// 	responseMessage.Token = message.Token
-	// }
-	// responseMessage.CloneOptions(message, OptionBlock1, OptionBlock2)
-
-	// _, err := server.sr.SendTo(responseMessage, message.Sender)
-	// return err != nil
-	return false
+// requestFailed answers code without payload, see r.EmptyResponse.
+func requestFailed(sr *transport, message *m.CoAPMessage, code m.CoapCode) bool {
+	_, err := sr.SendTo(r.EmptyResponse(message, code), message.Sender)
+	return err != nil
 }
 
 func noResource(sr *transport, message *m.CoAPMessage) bool {
@@ -117,3 +174,18 @@ func noResource(sr *transport, message *m.CoAPMessage) bool {
 	_, err := sr.SendTo(responseMessage, message.Sender)
 	return err != nil
 }
+
+func serviceUnavailable(sr *transport, message *m.CoAPMessage) bool {
+	if message.Type != m.CON {
+		return false
+	}
+	responseMessage := m.NewCoAPMessageId(m.ACK, m.CoapCodeServiceUnavailable, message.MessageID)
+	responseMessage.Payload = m.NewStringPayload("Server is shutting down")
+	if message.Token != nil && len(message.Token) > 0 {
+		responseMessage.Token = message.Token
+	}
+	responseMessage.CloneOptions(message, m.OptionBlock1, m.OptionBlock2, m.OptionProxySecurityID)
+
+	_, err := sr.SendTo(responseMessage, message.Sender)
+	return err != nil
+}
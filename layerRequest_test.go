@@ -0,0 +1,89 @@
+package coalago
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	m "github.com/gusleein/coalago/message"
+	r "github.com/gusleein/coalago/resource"
+	log "github.com/ndmsystems/golog"
+)
+
+func init() {
+	log.Init("", "prod", "test")
+}
+
+// listen starts the server on a free port and returns its address once the
+// socket is bound, requests sent from then on wait in its buffer.
+func listen(t *testing.T, s *Server) string {
+	failed := make(chan error, 1)
+	go func() { failed <- s.Listen("127.0.0.1:0") }()
+
+	for {
+		s.mx.Lock()
+		sr := s.sr
+		s.mx.Unlock()
+		if sr != nil {
+			return sr.conn.LocalAddr().String()
+		}
+
+		select {
+		case err := <-failed:
+			t.Fatal(err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestNilResultInternalServerError(t *testing.T) {
+	s := NewServer()
+	s.GET("/nil", func(message *m.CoAPMessage) *r.CoAPResourceHandlerResult {
+		return nil
+	})
+	addr := listen(t, s)
+	defer s.Shutdown(context.Background())
+
+	resp, err := NewClient(WithTimeout(500 * time.Millisecond)).GET("coap://" + addr + "/nil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != m.CoapCodeInternalServerError {
+		t.Fatalf("expected %v, got %v", m.CoapCodeInternalServerError, resp.Code)
+	}
+}
+
+func TestNilResultSeparateResponse(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 8*1024)
+
+	responded := make(chan error, 1)
+	s := NewServer(WithNilResultPolicy(NilResultSeparateResponse))
+	s.GET("/later/{size}", func(message *m.CoAPMessage) *r.CoAPResourceHandlerResult {
+		payload := []byte("done")
+		if message.PathParam("size") == "big" {
+			payload = big
+		}
+		go func() {
+			time.Sleep(700 * time.Millisecond)
+			responded <- s.Respond(message, r.NewResponse(m.NewBytesPayload(payload), m.CoapCodeContent))
+		}()
+		return nil
+	})
+	addr := listen(t, s)
+	defer s.Shutdown(context.Background())
+
+	client := NewClient(WithTimeout(500 * time.Millisecond))
+	for size, expected := range map[string][]byte{"small": []byte("done"), "big": big} {
+		resp, err := client.GET("coap://" + addr + "/later/" + size)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		if resp.Code != m.CoapCodeContent || !bytes.Equal(resp.Body, expected) {
+			t.Fatalf("%s: unexpected response %v, %d bytes", size, resp.Code, len(resp.Body))
+		}
+		if err := <-responded; err != nil {
+			t.Fatal(size, err)
+		}
+	}
+}
@@ -14,7 +14,9 @@ import (
 	"github.com/patrickmn/go-cache"
 )
 
-var StorageLocalStates = cache.New(sumTimeAttempts, time.Second)
+// StorageLocalStates holds the exchanges in progress by sender and token.
+// Each is set with the sumTimeAttempts of the server it came to.
+var StorageLocalStates = cache.New(cache.NoExpiration, time.Second)
 
 type LocalStateFn func(*m.CoAPMessage)
 
@@ -24,6 +26,10 @@ func MakeLocalStateFn(r Resourcer, tr *transport, respHandler func(*m.CoAPMessag
 	var totalBlocks1 = -1
 	var runnedHandler int32 = 0
 	var downloadStartTime = time.Now()
+	var stream *requestStream
+	var upload *partialUpload
+	var tagged bool
+	var slot = &handlerSlot{r: r}
 
 	return func(message *m.CoAPMessage) {
 		mx.Lock()
@@ -42,22 +48,143 @@ func MakeLocalStateFn(r Resourcer, tr *transport, respHandler func(*m.CoAPMessag
 			atomic.StoreInt32(&runnedHandler, 1)
 
 			if err != nil {
+				slot.release()
 				return
 			}
 
-			requestOnReceive(r.getResourceForPathAndMethod(message.GetURIPath(), message.GetMethod()), tr, message)
-			closeCallback()
-			if len(bufBlock1) > 0 {
-				log.Debug(fmt.Sprintf("COALA U: %s, %s",
-					util.ByteCountBinary(int64(len(bufBlock1)*MAX_PAYLOAD_SIZE)),
-					util.ByteCountBinaryBits(int64(len(bufBlock1)*MAX_PAYLOAD_SIZE)*time.Second.Milliseconds()/time.Since(downloadStartTime).Milliseconds())))
+			if !slot.hold(0) {
+				serviceUnavailable(tr, message)
+				closeCallback()
+				return
+			}
+
+			receivedBlocks := len(bufBlock1)
+			go func() {
+				defer slot.release()
+
+				requestOnReceive(r, tr, message)
+				closeCallback()
+				if receivedBlocks > 0 {
+					log.Debug(fmt.Sprintf("COALA U: %s, %s",
+						util.ByteCountBinary(int64(receivedBlocks*tr.cfg.blockSize)),
+						util.ByteCountBinaryBits(util.PerSecond(int64(receivedBlocks*tr.cfg.blockSize), time.Since(downloadStartTime)))))
+				}
+			}()
+		}
+
+		if stream == nil && atomic.LoadInt32(&runnedHandler) == 0 && message.Type == m.CON && message.GetBlock1() != nil {
+			// an upload is in flight from its first block on, so that
+			// Shutdown waits for it
+			if !slot.hold(tr.cfg.sumTimeAttempts()) {
+				serviceUnavailable(tr, message)
+				closeCallback()
+				return
+			}
+		}
+
+		if stream == nil && streamsRequest(r, message) {
+			if stream = startRequestStream(r, tr, slot, message, totalBlocks1, bufBlock1, closeCallback); stream == nil {
+				return
+			}
+		}
+		if stream != nil {
+			stream.receive(message)
+			return
+		}
+
+		if !tagged && isTaggedBlock1(message) {
+			kept, ok := tr.cfg.uploads.open(message)
+			if !ok {
+				// the blocks the upload goes on from are not kept
+				requestFailed(tr, message, m.CoapCodeRequestEntityIncomplete)
+				slot.release()
+				closeCallback()
+				return
+			}
+			upload, tagged = kept, true
+		}
+		if upload != nil {
+			request, done, fits := upload.receive(tr, message)
+			switch {
+			case !fits:
+				tr.cfg.uploads.drop(upload)
+				upload, tagged = nil, false
+				requestFailed(tr, message, m.CoapCodeRequestEntityTooLarge)
+				slot.release()
+				closeCallback()
+			case done:
+				tr.cfg.uploads.drop(upload)
+				respHandler(request, nil)
+			default:
+				tr.cfg.uploads.keep(upload)
 			}
+			return
 		}
 
 		totalBlocks1, bufBlock1 = localStateMessageHandlerSelector(tr, totalBlocks1, bufBlock1, message, respHandler)
 	}
 }
 
+// handlerSlot is the place of an exchange among the in-flight handlers of
+// the server, which Shutdown waits for.
+type handlerSlot struct {
+	mx   sync.Mutex
+	r    Resourcer
+	held bool
+	idle *time.Timer
+}
+
+// hold takes the slot unless it is held already. With a timeout the slot
+// is given back if hold is not called again within it, otherwise it is
+// kept until release.
+func (slot *handlerSlot) hold(timeout time.Duration) bool {
+	slot.mx.Lock()
+	defer slot.mx.Unlock()
+
+	if slot.idle != nil {
+		slot.idle.Stop()
+		slot.idle = nil
+	}
+	if !slot.held {
+		if !slot.r.acquireHandler() {
+			return false
+		}
+		slot.held = true
+	}
+
+	if timeout > 0 {
+		var idle *time.Timer
+		idle = time.AfterFunc(timeout, func() {
+			slot.mx.Lock()
+			defer slot.mx.Unlock()
+			if slot.idle == idle {
+				slot.idle = nil
+				slot.free()
+			}
+		})
+		slot.idle = idle
+	}
+	return true
+}
+
+func (slot *handlerSlot) release() {
+	slot.mx.Lock()
+	defer slot.mx.Unlock()
+
+	if slot.idle != nil {
+		slot.idle.Stop()
+		slot.idle = nil
+	}
+	slot.free()
+}
+
+func (slot *handlerSlot) free() {
+	if slot.held {
+		slot.held = false
+		slot.r.releaseHandler()
+	}
+}
+
 func localStateSecurityInputLayer(tr *transport, message *m.CoAPMessage, proxyAddr string) (isContinue bool, err error) {
 	if len(proxyAddr) > 0 {
 		proxyID, ok := getProxyIDIfNeed(proxyAddr, tr.conn.LocalAddr().String())
@@ -136,13 +263,14 @@ func localStateMessageHandlerSelector(
 			)
 			ok, totalBlocks, buffer, message, err = localStateReceiveARQBlock1(sr, totalBlocks, buffer, message)
 			if ok {
-				go respHandler(message, err)
+				respHandler(message, err)
 			}
 		}
 		return totalBlocks, buffer
 	}
 
-	if block2 != nil {
+	// a request may carry Block2 to ask for the blocks from a number on
+	if block2 != nil && message.Type != m.CON {
 		if message.Type == m.ACK {
 			id := message.Sender.String() + string(message.Token)
 
@@ -153,7 +281,7 @@ func localStateMessageHandlerSelector(
 		}
 		return totalBlocks, buffer
 	}
-	go respHandler(message, nil)
+	respHandler(message, nil)
 	return totalBlocks, buffer
 }
 
@@ -3,8 +3,10 @@ package coalaMsg
 import (
 	"encoding/binary"
 	"errors"
+	"io"
 	"math/rand"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -169,10 +171,30 @@ func MethodString(c CoapMethod) string {
 		return "POST"
 	case CoapMethodPut:
 		return "PUT"
+	case CoapMethodFetch:
+		return "FETCH"
+	case CoapMethodPatch:
+		return "PATCH"
+	case CoapMethodIPatch:
+		return "iPATCH"
 	}
 	return ""
 }
 
+// MethodsString joins the names of the methods with commas, e.g. "GET, PUT".
+// DELETE is spelled out, unlike in MethodString.
+func MethodsString(methods []CoapMethod) string {
+	names := make([]string, 0, len(methods))
+	for _, method := range methods {
+		if method == CoapMethodDelete {
+			names = append(names, "DELETE")
+			continue
+		}
+		names = append(names, MethodString(method))
+	}
+	return strings.Join(names, ", ")
+}
+
 func typeString(c CoapType) string {
 	switch c {
 	case CON:
@@ -243,6 +265,8 @@ func optionCodeToString(option OptionCode) string {
 		return "OptionСoapsUri"
 	case OptionProxySecurityID:
 		return "OptionSecurityID"
+	case OptionRequestTag:
+		return "RequestTag"
 	default:
 		return "Unknown"
 	}
@@ -254,7 +278,27 @@ func ConstructNextBlock(blockType OptionCode, s *StateSend) (*CoAPMessage, bool)
 		s.Stop = s.Lenght
 	}
 
-	blockbyte := s.Payload[s.Start:s.Stop]
+	return nextBlock(blockType, s, s.Payload[s.Start:s.Stop])
+}
+
+// ReadNextBlock is like ConstructNextBlock but reads the block from r
+// instead of Payload, so that a body of Lenght bytes is never held in
+// memory as a whole.
+func ReadNextBlock(blockType OptionCode, s *StateSend, r io.Reader) (*CoAPMessage, bool, error) {
+	s.Stop = s.Start + s.BlockSize
+	if s.Stop > s.Lenght {
+		s.Stop = s.Lenght
+	}
+
+	frame := make([]byte, s.Stop-s.Start)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, false, err
+	}
+	blockMessage, end := nextBlock(blockType, s, frame)
+	return blockMessage, end, nil
+}
+
+func nextBlock(blockType OptionCode, s *StateSend, blockbyte []byte) (*CoAPMessage, bool) {
 	isMore := s.Stop < s.Lenght
 
 	blockMessage := newBlockingMessage(
@@ -271,12 +315,32 @@ func ConstructNextBlock(blockType OptionCode, s *StateSend) (*CoAPMessage, bool)
 	s.NextNumBlock++
 	s.Start = s.Stop
 
-	blockMessage.CloneOptions(s.OrigMessage, OptionProxyURI, OptionProxySecurityID)
+	blockMessage.CloneOptions(s.OrigMessage, OptionProxyURI, OptionProxySecurityID, OptionRequestTag, OptionSize1)
 	blockMessage.ProxyAddr = s.OrigMessage.ProxyAddr
+	if blockType == OptionBlock2 {
+		// the block completing the transfer stands for the whole response,
+		// which may be any of them with selective repeat
+		blockMessage.AddOptions(responseOptions(s.OrigMessage))
+	}
 
 	return blockMessage, !isMore
 }
 
+// responseOptions are the options of a response other than those every
+// block gets on its own.
+func responseOptions(message *CoAPMessage) []*CoAPMessageOption {
+	var options []*CoAPMessageOption
+	for _, option := range message.Options {
+		switch option.Code {
+		case OptionURIScheme, OptionURIPath, OptionURIQuery, OptionBlock1, OptionBlock2,
+			OptionSelectiveRepeatWindowSize, OptionProxyURI, OptionProxySecurityID:
+			continue
+		}
+		options = append(options, option)
+	}
+	return options
+}
+
 func AckTo(initMessage *CoAPMessage, origMessage *CoAPMessage, code CoapCode) *CoAPMessage {
 	result := NewCoAPMessage(ACK, code)
 	result.MessageID = origMessage.MessageID
@@ -23,6 +23,11 @@ const (
 	CoapMethodPut    CoapMethod = 2
 	CoapMethodPost   CoapMethod = 3
 	CoapMethodDelete CoapMethod = 4
+
+	// RFC 8132
+	CoapMethodFetch  CoapMethod = 5
+	CoapMethodPatch  CoapMethod = 6
+	CoapMethodIPatch CoapMethod = 7
 )
 
 type CoapCode uint8
@@ -35,6 +40,11 @@ const (
 	PUT    CoapCode = 3
 	DELETE CoapCode = 4
 
+	// RFC 8132
+	FETCH  CoapCode = 5
+	PATCH  CoapCode = 6
+	IPATCH CoapCode = 7
+
 	// Response
 	CoapCodeEmpty    CoapCode = 0
 	CoapCodeCreated  CoapCode = 65
@@ -75,6 +85,12 @@ func (code CoapCode) String() string {
 		return "PUT"
 	case DELETE:
 		return "DELETE"
+	case FETCH:
+		return "FETCH"
+	case PATCH:
+		return "PATCH"
+	case IPATCH:
+		return "iPATCH"
 	case CoapCodeEmpty:
 		return "0 Empty"
 	case CoapCodeCreated:
@@ -103,6 +119,8 @@ func (code CoapCode) String() string {
 		return "405 Method Not Allowed"
 	case CoapCodeNotAcceptable:
 		return "406 Not Acceptable"
+	case CoapCodeRequestEntityIncomplete:
+		return "408 Request Entity Incomplete"
 	case CoapCodePreconditionFailed:
 		return "412 Precondition Failed"
 	case CoapCodeRequestEntityTooLarge:
@@ -137,8 +155,14 @@ func (c CoapCode) Group() string {
 	return "others"
 }
 
+// IsRequest reports whether the code belongs to the request class 0.xx,
+// including method codes that are not registered.
+func (c CoapCode) IsRequest() bool {
+	return c > 0 && c < 32
+}
+
 func (c *CoapCode) IsRegisteredMethod() bool {
-	return (*c > 0 && *c <= 4)
+	return (*c > 0 && *c <= IPATCH)
 }
 
 func (c *CoapCode) IsCommonError() bool {
@@ -174,6 +198,15 @@ const (
 	MediaTypeApplicationSoapFastInfoSet MediaType = 49
 	MediaTypeApplicationJSON            MediaType = 50
 	MediaTypeApplicationXObitBinary     MediaType = 51
+	MediaTypeApplicationCBOR            MediaType = 60
+	MediaTypeApplicationSenMLJSON       MediaType = 110
+	MediaTypeApplicationSensMLJSON      MediaType = 111
+	MediaTypeApplicationSenMLCBOR       MediaType = 112
+	MediaTypeApplicationSensMLCBOR      MediaType = 113
+	MediaTypeApplicationSenMLExi        MediaType = 114
+	MediaTypeApplicationSensMLExi       MediaType = 115
+	MediaTypeApplicationSenMLXML        MediaType = 310
+	MediaTypeApplicationSensMLXML       MediaType = 311
 	MediaTypeTextPlainVndOmaLwm2m       MediaType = 1541
 	MediaTypeTlvVndOmaLwm2m             MediaType = 1542
 	MediaTypeJSONVndOmaLwm2m            MediaType = 1543
@@ -211,6 +244,7 @@ const (
 	OptionProxyURI      OptionCode = 35
 	OptionProxyScheme   OptionCode = 39
 	OptionSize1         OptionCode = 60
+	OptionRequestTag    OptionCode = 292 // RFC 9175
 
 	/// URI scheme options specifies scheme to be used for message transmission
 	/// See `CoAPMessage.GetScheme()`. Scheme is stored using it's raw value
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
 	"sort"
@@ -13,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	cerr "github.com/gusleein/coalago/errors"
 	"github.com/gusleein/coalago/util"
 )
@@ -40,6 +42,16 @@ type CoAPMessage struct {
 
 	ProxyAddr string
 	Context   context.Context
+
+	// PathParams holds the values captured by the path template of the
+	// resource the message was routed to
+	PathParams map[string]string
+
+	// Body streams the payload of a block-wise request to a stream handler
+	// as its blocks arrive, nil if the payload came as a whole. Once Body is
+	// read to the end, MessageID and Block1 are those of the last block.
+	// A response sends Body of Size2 bytes instead of Payload.
+	Body io.Reader
 }
 
 func NewCoAPMessage(messageType CoapType, messageCode CoapCode) *CoAPMessage {
@@ -175,7 +187,7 @@ func deserialize(data []byte) (*CoAPMessage, error) {
 			switch optCode {
 			case OptionURIScheme, OptionProxyScheme, OptionURIPort, OptionContentFormat, OptionMaxAge, OptionAccept, OptionSize1,
 				OptionSize2, OptionBlock1, OptionBlock2, OptionHandshakeType, OptionObserve,
-				OptionSessionNotFound, OptionSessionExpired, OptionSelectiveRepeatWindowSize, OptionProxySecurityID:
+				OptionSessionNotFound, OptionSessionExpired, OptionSelectiveRepeatWindowSize, OptionProxySecurityID, OptionIfNoneMatch:
 				// OptionWindowtOffset
 
 				intVal, err := decodeInt(optionValue)
@@ -184,13 +196,15 @@ func deserialize(data []byte) (*CoAPMessage, error) {
 				}
 				msg.Options = append(msg.Options, NewOption(optCode, intVal))
 
-			case OptionURIHost, OptionEtag, OptionLocationPath, OptionURIPath, OptionURIQuery,
-				OptionLocationQuery, OptionProxyURI, OptionСoapsUri:
+			case OptionURIHost, OptionEtag, OptionIfMatch, OptionLocationPath, OptionURIPath, OptionURIQuery,
+				OptionLocationQuery, OptionProxyURI, OptionСoapsUri, OptionRequestTag:
 				msg.Options = append(msg.Options, NewOption(optCode, string(optionValue)))
 			default:
 				if lastOptionID&0x01 == 1 {
 					return msg, cerr.UnknownCriticalOption
 				}
+				// unknown elective options, e.g. vendor ones, are kept opaque
+				msg.Options = append(msg.Options, NewOption(optCode, string(optionValue)))
 			}
 			tmp = tmp[optionLength:]
 		} else {
@@ -320,6 +334,12 @@ func (m *CoAPMessage) GetMethod() CoapMethod {
 		return CoapMethodPut
 	case DELETE:
 		return CoapMethodDelete
+	case FETCH:
+		return CoapMethodFetch
+	case PATCH:
+		return CoapMethodPatch
+	case IPATCH:
+		return CoapMethodIPatch
 	default:
 		return 0
 	}
@@ -351,6 +371,12 @@ func (m *CoAPMessage) GetURIPath() string {
 	return "/" + strings.Join(opts, "/")
 }
 
+// PathParam returns the value captured by the "{name}" segment of the
+// resource path template, or the rest of the path matched by "*".
+func (m *CoAPMessage) PathParam(name string) string {
+	return m.PathParams[name]
+}
+
 func (m *CoAPMessage) GetURIQueryString() string {
 	options := m.GetOptions(OptionURIQuery)
 
@@ -428,6 +454,15 @@ func (m *CoAPMessage) SetMediaType(mt MediaType) {
 	m.AddOption(OptionContentFormat, mt)
 }
 
+// Decode unmarshals the payload into v by its Content-Format, see Unmarshal.
+func (m *CoAPMessage) Decode(v interface{}) error {
+	mediaType := MediaType(-1)
+	if option := m.GetOption(OptionContentFormat); option != nil {
+		mediaType = MediaType(option.IntValue())
+	}
+	return Unmarshal(mediaType, m.GetPayload(), v)
+}
+
 func (m *CoAPMessage) SetStringPayload(s string) {
 	m.Payload = NewStringPayload(s)
 }
@@ -446,6 +481,25 @@ func (m *CoAPMessage) SetURIQuery(k, v string) {
 	m.AddOption(OptionURIQuery, k+"="+v)
 }
 
+// SetLocation sets the Location-Path and Location-Query options of a
+// 2.01 Created response from a relative URI such as /items/12?rev=3.
+func (m *CoAPMessage) SetLocation(location string) {
+	path, query := location, ""
+	if i := strings.IndexByte(location, '?'); i >= 0 {
+		path, query = location[:i], location[i+1:]
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			m.AddOption(OptionLocationPath, segment)
+		}
+	}
+	for _, q := range strings.Split(query, "&") {
+		if q != "" {
+			m.AddOption(OptionLocationQuery, q)
+		}
+	}
+}
+
 func (m *CoAPMessage) SetToken(t string) {
 	m.Token = []byte(t)
 }
@@ -629,3 +683,41 @@ func (p *JSONPayload) Length() int {
 func (p *JSONPayload) String() string {
 	return string(p.Bytes())
 }
+
+func NewCBORPayload(obj interface{}) CoAPMessagePayload {
+	return &CBORPayload{
+		obj: obj,
+	}
+}
+
+// Represents a message payload containing CBOR data (RFC 8949)
+type CBORPayload struct {
+	obj interface{}
+}
+
+func (p *CBORPayload) Bytes() []byte {
+	o, err := cbor.Marshal(p.obj)
+	if err != nil {
+		return []byte{}
+	}
+	return o
+}
+func (p *CBORPayload) Length() int {
+	return len(p.Bytes())
+}
+func (p *CBORPayload) String() string {
+	return fmt.Sprintf("%x", p.Bytes())
+}
+
+// Unmarshal decodes data of the media type into v. JSON and CBOR based
+// formats, SenML included, are supported. Data without a media type (-1)
+// is taken for JSON, which NewJSONPayload responses are sent as.
+func Unmarshal(mediaType MediaType, data []byte, v interface{}) error {
+	switch mediaType {
+	case -1, MediaTypeApplicationJSON, MediaTypeApplicationSenMLJSON, MediaTypeApplicationSensMLJSON:
+		return json.Unmarshal(data, v)
+	case MediaTypeApplicationCBOR, MediaTypeApplicationSenMLCBOR, MediaTypeApplicationSensMLCBOR:
+		return cbor.Unmarshal(data, v)
+	}
+	return cerr.UnsupportedContentFormat
+}
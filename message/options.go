@@ -20,6 +20,11 @@ func (o *CoAPMessageOption) IsCritical() bool {
 	return int(o.Code)%2 != 0
 }
 
+// Determines if an option is left out of the cache key (RFC 7252, section 5.4.6)
+func (o *CoAPMessageOption) IsNoCacheKey() bool {
+	return int(o.Code)&0x1e == 0x1c
+}
+
 // Returns the string value of an option
 func (o *CoAPMessageOption) StringValue() string {
 	if str, ok := o.Value.(string); ok {
@@ -37,6 +42,8 @@ func (o *CoAPMessageOption) IntValue() int {
 	switch o.Value.(type) {
 	case int:
 		return o.Value.(int)
+	case MediaType:
+		return int(o.Value.(MediaType))
 	case int8:
 		return int(o.Value.(int8))
 	case int16:
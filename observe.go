@@ -0,0 +1,210 @@
+package coalago
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	m "github.com/gusleein/coalago/message"
+	r "github.com/gusleein/coalago/resource"
+	"github.com/gusleein/coalago/util"
+)
+
+// Observe sequence numbers are 24-bit (RFC 7641, section 4.4)
+const maxObserveSeq = 1<<24 - 1
+
+type observer struct {
+	key     string
+	path    string
+	addr    net.Addr
+	request *m.CoAPMessage
+}
+
+type observedResource struct {
+	seq       int
+	observers map[string]*observer
+}
+
+type observeRegistry struct {
+	mx        sync.Mutex
+	resources map[string]*observedResource
+}
+
+func newObserveRegistry() *observeRegistry {
+	o := new(observeRegistry)
+	o.resources = make(map[string]*observedResource)
+	return o
+}
+
+func observerKey(addr net.Addr, token []byte) string {
+	return addr.String() + string(token)
+}
+
+// register adds the sender of the request to the observers of the requested
+// resource and returns the sequence number for the registration response.
+func (o *observeRegistry) register(message *m.CoAPMessage) int {
+	path := strings.Trim(message.GetURIPath(), "/ ")
+
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	res, ok := o.resources[path]
+	if !ok {
+		res = &observedResource{observers: make(map[string]*observer)}
+		o.resources[path] = res
+	}
+
+	key := observerKey(message.Sender, message.Token)
+	res.observers[key] = &observer{
+		key:     key,
+		path:    path,
+		addr:    message.Sender,
+		request: message,
+	}
+	return res.seq
+}
+
+func (o *observeRegistry) deregister(path string, key string) {
+	path = strings.Trim(path, "/ ")
+
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	res, ok := o.resources[path]
+	if !ok {
+		return
+	}
+	delete(res.observers, key)
+	if len(res.observers) == 0 {
+		delete(o.resources, path)
+	}
+}
+
+// next advances the sequence number of the resource and returns it together
+// with the observers to be notified.
+func (o *observeRegistry) next(path string) (int, []*observer) {
+	path = strings.Trim(path, "/ ")
+
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	res, ok := o.resources[path]
+	if !ok {
+		return 0, nil
+	}
+	res.seq++
+	if res.seq > maxObserveSeq {
+		res.seq = 0
+	}
+
+	observers := make([]*observer, 0, len(res.observers))
+	for _, obs := range res.observers {
+		observers = append(observers, obs)
+	}
+	return res.seq, observers
+}
+
+func (o *observeRegistry) count(path string) int {
+	path = strings.Trim(path, "/ ")
+
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	if res, ok := o.resources[path]; ok {
+		return len(res.observers)
+	}
+	return 0
+}
+
+// Notify pushes the current representation of the resource at path to all
+// of its observers. Each observer gets a confirmable notification; observers
+// that reject it with RST or leave it unacknowledged are removed. Nothing is
+// sent once Shutdown has been called.
+func (s *Server) Notify(path string) {
+	s.mx.Lock()
+	sr := s.sr
+	s.mx.Unlock()
+	if sr == nil {
+		return
+	}
+
+	seq, observers := s.observers.next(path)
+	for _, obs := range observers {
+		// a notification is in flight like a handler, so that Shutdown
+		// waits for it and none is sent after
+		if !s.acquireHandler() {
+			return
+		}
+		go func(obs *observer) {
+			defer s.releaseHandler()
+			s.notify(sr, obs, seq)
+		}(obs)
+	}
+}
+
+// Observers returns the number of endpoints observing the resource at path.
+func (s *Server) Observers(path string) int {
+	return s.observers.count(path)
+}
+
+func (s *Server) notify(sr *transport, obs *observer, seq int) {
+	var result *r.CoAPResourceHandlerResult
+	if res, _ := s.getResourceForPathAndMethod(obs.path, m.CoapMethodGet); res != nil {
+		if handler, mediaType, code := res.Negotiate(obs.request); code != 0 {
+			result = r.NewResponse(m.NewEmptyPayload(), code)
+		} else {
+			var panicked bool
+			var err error
+			if result, panicked = r.Call(s.withMiddlewares(handler), obs.request); !panicked {
+				result, err = res.Render(result, mediaType)
+			}
+			if panicked || err != nil {
+				result = r.NewResponse(m.NewStringPayload("Resource handler failed"), m.CoapCodeInternalServerError)
+			}
+		}
+	}
+	if result == nil {
+		result = r.NewResponse(m.NewStringPayload("Requested resource "+obs.request.GetURIPath()+" does not exist"), m.CoapCodeNotFound)
+	}
+	// a notification is a single message, a larger representation is
+	// announced by its first block and the client asks for the rest (RFC
+	// 7959, section 2.6)
+	size := 0
+	if result.Body != nil {
+		size = int(result.Size)
+		payload, err := ioutil.ReadAll(io.NewSectionReader(result.Body, 0, int64(sr.cfg.blockSize)))
+		result.Close()
+		if err != nil {
+			result = r.NewResponse(m.NewStringPayload("Resource handler failed"), m.CoapCodeInternalServerError)
+		} else {
+			result.Payload, result.Body = m.NewBytesPayload(payload), nil
+		}
+	} else if result.Payload != nil {
+		size = result.Payload.Length()
+	}
+
+	notification := r.ResponseMessage(obs.request, result)
+	notification.Type = m.CON
+	notification.MessageID = m.NewCoAPMessage(m.CON, result.Code).MessageID
+	for _, option := range []m.OptionCode{m.OptionBlock1, m.OptionBlock2, m.OptionSelectiveRepeatWindowSize} {
+		notification.RemoveOptions(option)
+	}
+	if size > sr.cfg.blockSize {
+		notification.Payload = m.NewBytesPayload(notification.Payload.Bytes()[:sr.cfg.blockSize])
+		notification.AddOption(m.OptionBlock2, util.NewBlock(true, 0, sr.cfg.blockSize).ToInt())
+		notification.AddOption(m.OptionSize2, size)
+	}
+
+	// a non-2.xx notification ends the observation (RFC 7641, section 3.2)
+	if result.Code.Group() == "2.xx" {
+		notification.AddOption(m.OptionObserve, seq)
+	} else {
+		s.observers.deregister(obs.path, obs.key)
+	}
+
+	if !s.sendConfirmable(sr, notification, obs.addr) {
+		s.observers.deregister(obs.path, obs.key)
+	}
+}
@@ -0,0 +1,208 @@
+package coalago
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+
+	cerr "github.com/gusleein/coalago/errors"
+	m "github.com/gusleein/coalago/message"
+)
+
+// default freshness of a notification without Max-Age (RFC 7252, section 5.10.5)
+const defaultMaxAge = 60 * time.Second
+
+// Observe registers interest in the resource at url (RFC 7641) and delivers
+// the registration response followed by every fresh notification to the
+// returned channel. Stale or reordered notifications are dropped, the
+// registration is renewed when Max-Age of the last notification expires,
+// and cancelling ctx deregisters and closes the channel. The channel is
+// also closed when the server ends the observation or stops answering.
+func (c *Client) Observe(ctx context.Context, url string, options ...*m.CoAPMessageOption) (<-chan *Response, error) {
+	message, err := constructMessage(m.GET, url)
+	if err != nil {
+		return nil, err
+	}
+	message.AddOptions(options)
+	message.AddOption(m.OptionObserve, 0)
+	message.Context = ctx
+	message.Timeout = c.cfg.timeWait
+
+	conn, err := c.pool.Dial(message.Recipient.String())
+	if err != nil {
+		return nil, err
+	}
+
+	sr := newtransport(conn, c.cfg)
+	sr.privateKey = c.privateKey
+
+	resp, err := sr.Send(message)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ch := make(chan *Response, 1)
+	ch <- sr.newObserveResponse(message, resp)
+
+	if resp.GetOption(m.OptionObserve) == nil {
+		// the server does not support observation of the resource
+		conn.Close()
+		close(ch)
+		return ch, nil
+	}
+
+	go sr.observe(ctx, message, resp, ch)
+	return ch, nil
+}
+
+func (sr *transport) newObserveResponse(registration, message *m.CoAPMessage) *Response {
+	r := newResponse(message)
+	r.RemoteAddr = sr.conn.RemoteAddr()
+	r.base = &url.URL{Scheme: registration.GetSchemeString(), Host: registration.Recipient.String()}
+	return r
+}
+
+func (sr *transport) observe(ctx context.Context, registration *m.CoAPMessage, last *m.CoAPMessage, ch chan *Response) {
+	defer sr.conn.Close()
+	defer close(ch)
+	defer sr.watchContext(ctx)()
+
+	lastSeq := last.GetOption(m.OptionObserve).IntValue()
+	lastTime := time.Now()
+	wait := notificationMaxAge(last) + sr.cfg.timeWait
+	attempts := 0
+
+	for {
+		sr.conn.SetReadDeadlineSec(wait)
+		if ctx.Err() != nil {
+			sr.deregister(registration)
+			return
+		}
+
+		buff := make([]byte, MTU+1)
+		n, err := sr.conn.Read(buff)
+		if err != nil {
+			if ctx.Err() != nil {
+				sr.deregister(registration)
+				return
+			}
+			neterr, ok := err.(net.Error)
+			if !ok || !neterr.Timeout() || attempts == sr.cfg.maxSendAttempts {
+				return
+			}
+			// Max-Age expired without a notification, renew the registration
+			attempts++
+			wait = sr.cfg.timeWait
+			sr.reregister(registration, false)
+			continue
+		}
+		if n > MTU {
+			continue
+		}
+
+		message, err := preparationReceivingBuffer(sr, buff[:n], sr.conn.RemoteAddr(), registration.ProxyAddr)
+		if err == cerr.SessionNotFound || err == cerr.SessionExpired {
+			sr.reregister(registration, true)
+			continue
+		}
+		if err != nil || string(message.Token) != string(registration.Token) {
+			continue
+		}
+
+		if message.Type == m.CON {
+			sr.sendToSocket(m.AckTo(registration, message, m.CoapCodeEmpty))
+		}
+
+		option := message.GetOption(m.OptionObserve)
+		if option == nil {
+			// the server cancelled the observation, deliver the final response
+			select {
+			case ch <- sr.newObserveResponse(registration, message):
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		attempts = 0
+		wait = notificationMaxAge(message) + sr.cfg.timeWait
+
+		seq, now := option.IntValue(), time.Now()
+		if !isFreshNotification(lastSeq, seq, lastTime, now) {
+			continue
+		}
+		lastSeq, lastTime = seq, now
+
+		if block := message.GetBlock2(); block != nil && block.MoreBlocks {
+			if message, err = sr.fetchNotified(registration, message); err != nil {
+				continue
+			}
+		}
+
+		select {
+		case ch <- sr.newObserveResponse(registration, message):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// fetchNotified gets the whole representation of a notification carrying
+// only its first block (RFC 7959, section 2.6), as the response to a GET
+// of its own token.
+func (sr *transport) fetchNotified(registration, notification *m.CoAPMessage) (*m.CoAPMessage, error) {
+	message := registration.Clone(false)
+	message.MessageID = m.NewCoAPMessage(m.CON, m.GET).MessageID
+	message.Token = m.GenerateToken(8)
+	message.RemoveOptions(m.OptionObserve)
+	message.Context = registration.Context
+	message.Timeout = registration.Timeout
+
+	resp, err := sr.Send(message)
+	if err != nil {
+		return nil, err
+	}
+	resp.RemoveOptions(m.OptionObserve)
+	resp.AddOption(m.OptionObserve, notification.GetOption(m.OptionObserve).IntValue())
+	return resp, nil
+}
+
+// reregister renews the registration with the same token, restarting the
+// coaps:// session first if the server reported it lost.
+func (sr *transport) reregister(registration *m.CoAPMessage, renewSession bool) {
+	message := registration.Clone(true)
+	message.MessageID = m.NewCoAPMessage(m.CON, m.GET).MessageID
+	message.Context = registration.Context
+
+	if renewSession && message.GetScheme() == m.COAPS_SCHEME {
+		deleteSessionForAddress(sr.conn.LocalAddr().String(), sr.conn.RemoteAddr().String(), message.ProxyAddr)
+		if _, err := handshake(sr, message, sr.conn.RemoteAddr(), message.ProxyAddr); err != nil {
+			return
+		}
+	}
+	sr.sendToSocket(message)
+}
+
+func (sr *transport) deregister(registration *m.CoAPMessage) {
+	message := registration.Clone(true)
+	message.MessageID = m.NewCoAPMessage(m.CON, m.GET).MessageID
+	message.Options = nil
+	message.CloneOptions(registration, m.OptionURIScheme, m.OptionURIPath, m.OptionURIQuery, m.OptionProxyURI, m.OptionProxySecurityID)
+	message.AddOption(m.OptionObserve, 1)
+	sr.sendToSocket(message)
+}
+
+func notificationMaxAge(message *m.CoAPMessage) time.Duration {
+	if option := message.GetOption(m.OptionMaxAge); option != nil {
+		return time.Duration(option.IntValue()) * time.Second
+	}
+	return defaultMaxAge
+}
+
+// isFreshNotification applies the reordering rule of RFC 7641, section 3.4
+// to the sequence numbers v1, v2 of notifications received at t1 and t2.
+func isFreshNotification(v1, v2 int, t1, t2 time.Time) bool {
+	return (v1 < v2 && v2-v1 < 1<<23) ||
+		(v1 > v2 && v1-v2 > 1<<23) ||
+		t2.After(t1.Add(128*time.Second))
+}
@@ -0,0 +1,179 @@
+package coalago
+
+import "time"
+
+// NilResultPolicy tells a Server how to answer a confirmable request whose
+// handler returned nil.
+type NilResultPolicy int
+
+const (
+	// NilResultInternalServerError answers 5.00 Internal Server Error at once.
+	NilResultInternalServerError NilResultPolicy = iota
+	// NilResultSeparateResponse answers with an empty ACK, the handler is
+	// expected to deliver the result later through Server.Respond.
+	NilResultSeparateResponse
+)
+
+// Option tunes the retransmission, block-wise transfer and session
+// parameters of a Client or a Server.
+type Option func(*config)
+
+type config struct {
+	timeWait          time.Duration
+	maxSendAttempts   int
+	blockSize         int
+	windowSize        int
+	minWindowSize     int
+	maxWindowSize     int
+	sessionExpiration time.Duration
+	numberConnections int
+	nilResultPolicy   NilResultPolicy
+	cache             CacheStore
+
+	separateResponseAfter   time.Duration
+	separateResponseTimeout time.Duration
+	uploads                 *uploadStore
+}
+
+func newConfig(opts []Option) *config {
+	cfg := &config{
+		timeWait:          timeWait,
+		maxSendAttempts:   maxSendAttempts,
+		blockSize:         MAX_PAYLOAD_SIZE,
+		windowSize:        DEFAULT_WINDOW_SIZE,
+		minWindowSize:     MIN_WiNDOW_SIZE,
+		maxWindowSize:     MAX_WINDOW_SIZE,
+		sessionExpiration: SESSIONS_POOL_EXPIRATION,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// sumTimeAttempts is the longest time an exchange may stay unanswered.
+func (cfg *config) sumTimeAttempts() time.Duration {
+	return cfg.timeWait*time.Duration(cfg.maxSendAttempts) + 100
+}
+
+// WithTimeout sets how long to wait for an ACK before retransmitting.
+func WithTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		if d > 0 {
+			cfg.timeWait = d
+		}
+	}
+}
+
+// WithMaxRetransmit sets how many times a message is sent before giving up
+// with cerr.MaxAttempts.
+func WithMaxRetransmit(n int) Option {
+	return func(cfg *config) {
+		if n > 0 {
+			cfg.maxSendAttempts = n
+		}
+	}
+}
+
+// WithBlockSize sets the payload size of a single block in Block1/Block2
+// transfers. The value is rounded down to a power of two between 16 and 1024.
+func WithBlockSize(n int) Option {
+	return func(cfg *config) {
+		if n < 16 {
+			return
+		}
+		size := 16
+		for size*2 <= n && size < MAX_PAYLOAD_SIZE {
+			size *= 2
+		}
+		cfg.blockSize = size
+	}
+}
+
+// WithWindowSize sets the initial selective repeat window and the bounds
+// the window is balanced within during a transfer.
+func WithWindowSize(initial, min, max int) Option {
+	return func(cfg *config) {
+		if min <= 0 || min > max || initial < min || initial > max {
+			return
+		}
+		cfg.windowSize = initial
+		cfg.minWindowSize = min
+		cfg.maxWindowSize = max
+	}
+}
+
+// WithSessionExpiration sets how long an idle coaps:// session is kept.
+func WithSessionExpiration(d time.Duration) Option {
+	return func(cfg *config) {
+		if d > 0 {
+			cfg.sessionExpiration = d
+		}
+	}
+}
+
+// WithMaxConnections gives a Client its own pool limited to n simultaneous
+// connections instead of sharing the global one sized by NumberConnections.
+func WithMaxConnections(n int) Option {
+	return func(cfg *config) {
+		if n > 0 {
+			cfg.numberConnections = n
+		}
+	}
+}
+
+// WithNilResultPolicy sets how the Server answers requests whose handler
+// returned nil. The default is NilResultInternalServerError.
+func WithNilResultPolicy(policy NilResultPolicy) Option {
+	return func(cfg *config) {
+		cfg.nilResultPolicy = policy
+	}
+}
+
+// WithSeparateResponse makes the Server acknowledge a confirmable request
+// with an empty ACK once its handler has been running for d, and send the
+// result later as a separate confirmable response (RFC 7252, section 5.2.2).
+// It should be shorter than the timeout of the clients. Disabled by default.
+func WithSeparateResponse(d time.Duration) Option {
+	return func(cfg *config) {
+		if d > 0 {
+			cfg.separateResponseAfter = d
+		}
+	}
+}
+
+// WithSeparateResponseTimeout sets how long a Client waits for the separate
+// response to a request the server acknowledged with an empty ACK, e.g.
+// SEPARATE_RESPONSE_TIMEOUT, the exchange lifetime of RFC 7252. The Context
+// of the request may end the wait earlier. By default the wait is as long
+// as the retransmissions of a message, as an empty ACK also starts every
+// Block2 transfer.
+func WithSeparateResponseTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		if d > 0 {
+			cfg.separateResponseTimeout = d
+		}
+	}
+}
+
+// WithCache makes a Client answer GET requests from store while the
+// responses are fresh and revalidate stale ones by ETag (RFC 7252,
+// section 5.6). Disabled by default.
+func WithCache(store CacheStore) Option {
+	return func(cfg *config) {
+		cfg.cache = store
+	}
+}
+
+// WithUploadRetention makes the Server keep the blocks of an interrupted
+// upload tagged with Request-Tag for d after the last of them, so that the
+// client can resume it with Client.UploadResumable. The blocks are kept in
+// memory, only for uploads announcing their size in Size1 and up to maxSize
+// bytes of uploads in all. Disabled by default.
+func WithUploadRetention(d time.Duration, maxSize int64) Option {
+	return func(cfg *config) {
+		if d > 0 && maxSize > 0 {
+			cfg.uploads = newUploadStore(d, maxSize)
+		}
+	}
+}
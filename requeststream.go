@@ -0,0 +1,121 @@
+package coalago
+
+import (
+	"io"
+	"time"
+
+	cerr "github.com/gusleein/coalago/errors"
+	m "github.com/gusleein/coalago/message"
+	"github.com/gusleein/coalago/util"
+)
+
+// requestStream feeds a Block1 request to a stream handler through the Body
+// of request as its blocks arrive in order. The blocks are written by a
+// goroutine of its own and acknowledged only once written or waiting within
+// the window. A block coming while input is full is dropped unacknowledged,
+// so that a handler falling behind holds the sender back.
+type requestStream struct {
+	request *m.CoAPMessage
+	input   chan *m.CoAPMessage
+	done    chan struct{}
+}
+
+// streamsRequest reports whether message is the first block of a request to
+// a stream resource.
+func streamsRequest(r Resourcer, message *m.CoAPMessage) bool {
+	block := message.GetBlock1()
+	if message.Type != m.CON || block == nil || block.BlockNumber != 0 || !block.MoreBlocks {
+		return false
+	}
+	resource, _ := r.getResourceForPathAndMethod(message.GetURIPath(), message.GetMethod())
+	return resource != nil && resource.Streams()
+}
+
+// startRequestStream runs the handler of the request message starts, nil if
+// the server is shutting down. The blocks received ahead of the first one
+// are fed to the handler next.
+func startRequestStream(r Resourcer, tr *transport, slot *handlerSlot, message *m.CoAPMessage, totalBlocks int, received map[int][]byte, closeCallback func()) *requestStream {
+	if !slot.hold(0) {
+		serviceUnavailable(tr, message)
+		closeCallback()
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	request := *message
+	request.Options = append([]*m.CoAPMessageOption(nil), message.Options...)
+	request.Payload = m.NewEmptyPayload()
+	request.Body = pr
+
+	st := &requestStream{
+		request: &request,
+		input:   make(chan *m.CoAPMessage, tr.cfg.windowSize),
+		done:    make(chan struct{}),
+	}
+
+	blocks := util.NewBlockWriter(pw, nil)
+	blocks.Total = totalBlocks
+	for num, data := range received {
+		blocks.Hold(num, data)
+	}
+	go st.feed(tr, pw, blocks)
+
+	go func() {
+		defer slot.release()
+
+		requestOnReceive(r, tr, st.request)
+		pr.Close()
+		closeCallback()
+	}()
+	return st
+}
+
+// receive hands a block over to feed without waiting for it.
+func (st *requestStream) receive(message *m.CoAPMessage) {
+	select {
+	case <-st.done:
+	case st.input <- message:
+	default:
+		// not acknowledged, the block comes again
+	}
+}
+
+// feed writes the blocks to the body of the request until the last of
+// them, the handler stops reading or the blocks stop coming.
+func (st *requestStream) feed(tr *transport, body *io.PipeWriter, blocks *util.BlockWriter) {
+	defer close(st.done)
+
+	for {
+		select {
+		case message := <-st.input:
+			block := message.GetBlock1()
+			if block == nil || message.Type != m.CON {
+				continue
+			}
+
+			stored, err := blocks.Put(block.BlockNumber, message.Payload.Bytes(), block.MoreBlocks, tr.cfg.maxWindowSize)
+			if err != nil {
+				// the request was answered without reading it through
+				return
+			}
+			if !stored {
+				continue
+			}
+
+			if blocks.Done() {
+				// the response is the ACK of the block completing the request
+				st.request.MessageID = message.MessageID
+				st.request.RemoveOptions(m.OptionBlock1)
+				st.request.CloneOptions(message, m.OptionBlock1)
+				body.Close()
+				return
+			}
+
+			tr.sendToSocketByAddress(m.AckTo(nil, message, m.CoapCodeContinue), message.Sender)
+
+		case <-time.After(tr.cfg.sumTimeAttempts()):
+			body.CloseWithError(cerr.MaxAttempts)
+			return
+		}
+	}
+}
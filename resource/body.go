@@ -0,0 +1,62 @@
+package resource
+
+import (
+	"io"
+	"sync"
+
+	m "github.com/gusleein/coalago/message"
+)
+
+// NewBodyResponse returns a result whose payload is read from body block by
+// block as the response is sent, e.g. from an *os.File, so that a large
+// representation is never loaded as a whole. The size of body is found by
+// seeking to its end. A body that is an io.Closer is closed by the server
+// once the response is sent or dropped, see Close.
+func NewBodyResponse(body io.ReadSeeker, code m.CoapCode) (*CoAPResourceHandlerResult, error) {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	readerAt, ok := body.(io.ReaderAt)
+	if !ok {
+		readerAt = &seekReaderAt{rs: body}
+	}
+	return &CoAPResourceHandlerResult{Body: readerAt, Size: size, Code: code, MediaType: -1}, nil
+}
+
+// Close closes the Body of the result if it is an io.Closer. It is called
+// for every result a server is done with, the handler cannot do it as the
+// body is read after it returns.
+func (res *CoAPResourceHandlerResult) Close() error {
+	if res == nil {
+		return nil
+	}
+	if closer, ok := res.Body.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// seekReaderAt reads a body that can only seek at any offset.
+type seekReaderAt struct {
+	mx sync.Mutex
+	rs io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.rs, p)
+}
+
+func (s *seekReaderAt) Close() error {
+	if closer, ok := s.rs.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package resource
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	m "github.com/gusleein/coalago/message"
+)
+
+type seekOnly struct{ io.ReadSeeker }
+
+func TestNewBodyResponse(t *testing.T) {
+	for _, body := range []io.ReadSeeker{strings.NewReader("0123456789"), seekOnly{strings.NewReader("0123456789")}} {
+		result, err := NewBodyResponse(body, m.CoapCodeContent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Size != 10 {
+			t.Errorf("%T: size %d", body, result.Size)
+		}
+
+		b := make([]byte, 4)
+		if _, err := result.Body.ReadAt(b, 3); err != nil || string(b) != "3456" {
+			t.Errorf("%T: read %q, %v", body, b, err)
+		}
+	}
+}
+
+type closingBody struct {
+	*strings.Reader
+	closed bool
+}
+
+func (b *closingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestValidateClosesReplacedBody(t *testing.T) {
+	body := &closingBody{Reader: strings.NewReader("0123456789")}
+	result, _ := NewBodyResponse(body, m.CoapCodeContent)
+	result.ETag = []byte("v1")
+
+	request := m.NewCoAPMessage(m.CON, m.GET)
+	request.AddOption(m.OptionEtag, "v1")
+	if valid := Validate(request, result); valid.Code != m.CoapCodeValid || !body.closed {
+		t.Fatalf("expected 2.03 and the body closed, got %v, closed %v", valid.Code, body.closed)
+	}
+}
@@ -0,0 +1,149 @@
+package resource
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime/debug"
+
+	m "github.com/gusleein/coalago/message"
+	"github.com/gusleein/coalago/util"
+	log "github.com/ndmsystems/golog"
+)
+
+// Validate turns the 2.05 result of a GET or FETCH into 2.03 Valid without
+// payload if the request lists the ETag of the result (RFC 7252, section
+// 5.10.6.2). The result replaced is closed.
+func Validate(request *m.CoAPMessage, result *CoAPResourceHandlerResult) *CoAPResourceHandlerResult {
+	if result == nil || result.ETag == nil || result.Code != m.CoapCodeContent {
+		return result
+	}
+	if request.Code != m.GET && request.Code != m.FETCH {
+		return result
+	}
+	for _, etag := range request.GetOptions(m.OptionEtag) {
+		if bytes.Equal([]byte(etag.StringValue()), result.ETag) {
+			valid := &CoAPResourceHandlerResult{Payload: m.NewEmptyPayload(), Code: m.CoapCodeValid, MediaType: -1, ETag: result.ETag}
+			for _, option := range result.Options {
+				if option.Code == m.OptionMaxAge {
+					valid.Options = append(valid.Options, option)
+				}
+			}
+			result.Close()
+			return valid
+		}
+	}
+	return result
+}
+
+// HasPreconditions reports whether the request changing a resource carries
+// If-Match or If-None-Match.
+func HasPreconditions(request *m.CoAPMessage) bool {
+	switch request.Code {
+	case m.POST, m.PUT, m.DELETE, m.PATCH, m.IPATCH:
+		return request.GetOption(m.OptionIfMatch) != nil || request.GetOption(m.OptionIfNoneMatch) != nil
+	}
+	return false
+}
+
+// PreconditionsHold evaluates If-Match and If-None-Match (RFC 7252, section
+// 5.10.8) against the ETag of the current representation, nil if the
+// resource does not exist. A request they fail for is answered 4.12
+// Precondition Failed. Handlers of resources without ETagFunc call it
+// themselves, e.g. under the lock guarding the change they make.
+func PreconditionsHold(request *m.CoAPMessage, etag []byte) bool {
+	exists := etag != nil
+
+	if request.GetOption(m.OptionIfNoneMatch) != nil && exists {
+		return false
+	}
+
+	ifMatch := request.GetOptions(m.OptionIfMatch)
+	if len(ifMatch) == 0 {
+		return true
+	}
+	if !exists {
+		return false
+	}
+	for _, option := range ifMatch {
+		value := option.StringValue()
+		// an empty If-Match matches any representation
+		if value == "" || value == string(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// ETagFunc registers how the ETag of the current representation of the
+// resource is found, nil if it does not exist. The server then answers 4.12
+// to requests whose preconditions do not hold before running the handler.
+func (res *CoAPResource) ETagFunc(fn func(request *m.CoAPMessage) []byte) *CoAPResource {
+	res.etag = fn
+	return res
+}
+
+// PreconditionsFailed reports whether the request has preconditions that do
+// not hold for the ETag given by ETagFunc. Resources without ETagFunc leave
+// them to their handler.
+func (res *CoAPResource) PreconditionsFailed(request *m.CoAPMessage) (failed bool) {
+	if res.etag == nil || !HasPreconditions(request) {
+		return false
+	}
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			util.MetricHandlerPanics.Inc()
+			log.Error(fmt.Sprintf("COALA ETagFunc panic: %s %s: %v\n%s", request.Code.String(), request.GetURIPath(), rec, debug.Stack()))
+			failed = true
+		}
+	}()
+
+	return !PreconditionsHold(request, res.etag(request))
+}
+
+// EmptyResponse is the ACK answering the request with code and no payload,
+// e.g. 4.06, 4.12 or 4.15.
+func EmptyResponse(request *m.CoAPMessage, code m.CoapCode) *m.CoAPMessage {
+	responseMessage := m.NewCoAPMessageId(m.ACK, code, request.MessageID)
+	responseMessage.Payload = m.NewEmptyPayload()
+	responseMessage.Token = request.Token
+	if request.GetScheme() == m.COAPS_SCHEME {
+		responseMessage.SetSchemeCOAPS()
+	}
+	responseMessage.CloneOptions(request, m.OptionBlock1, m.OptionBlock2, m.OptionProxySecurityID)
+	return responseMessage
+}
+
+// ResponseMessage is the ACK answering the request with the result of its
+// handler. A result with a Body gets it as the Body of the message, to be
+// sent block by block, and its size in Size2.
+func ResponseMessage(request *m.CoAPMessage, result *CoAPResourceHandlerResult) *m.CoAPMessage {
+	responseMessage := m.NewCoAPMessageId(m.ACK, result.Code, request.MessageID)
+	responseMessage.Payload = result.Payload
+	if responseMessage.Payload == nil {
+		responseMessage.Payload = m.NewEmptyPayload()
+	}
+	if result.Body != nil {
+		responseMessage.Body = io.NewSectionReader(result.Body, 0, result.Size)
+		responseMessage.AddOption(m.OptionSize2, int(result.Size))
+	}
+	responseMessage.Token = request.Token
+
+	if result.MediaType >= 0 {
+		responseMessage.AddOption(m.OptionContentFormat, result.MediaType)
+	}
+	if result.ETag != nil {
+		responseMessage.AddOption(m.OptionEtag, string(result.ETag))
+	}
+	responseMessage.AddOptions(result.Options)
+	if result.Location != "" {
+		responseMessage.SetLocation(result.Location)
+	}
+
+	if request.GetScheme() == m.COAPS_SCHEME {
+		responseMessage.SetSchemeCOAPS()
+	}
+	responseMessage.CloneOptions(request, m.OptionBlock1, m.OptionBlock2, m.OptionSelectiveRepeatWindowSize, m.OptionProxySecurityID)
+	return responseMessage
+}
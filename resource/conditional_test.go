@@ -0,0 +1,73 @@
+package resource
+
+import (
+	"testing"
+
+	m "github.com/gusleein/coalago/message"
+)
+
+func TestPreconditionsHold(t *testing.T) {
+	current := []byte("v1")
+
+	tests := []struct {
+		option  m.OptionCode
+		value   interface{}
+		current []byte
+		hold    bool
+	}{
+		{m.OptionIfMatch, "v1", current, true},
+		{m.OptionIfMatch, "v2", current, false},
+		{m.OptionIfMatch, "", current, true},
+		{m.OptionIfMatch, "", nil, false},
+		{m.OptionIfNoneMatch, nil, current, false},
+		{m.OptionIfNoneMatch, nil, nil, true},
+	}
+	for i, test := range tests {
+		request := m.NewCoAPMessage(m.CON, m.PUT)
+		request.AddOption(test.option, test.value)
+		if !HasPreconditions(request) {
+			t.Fatalf("%d: preconditions not found", i)
+		}
+		if hold := PreconditionsHold(request, test.current); hold != test.hold {
+			t.Errorf("%d: got %v, want %v", i, hold, test.hold)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	result := NewResponse(m.NewStringPayload("x"), m.CoapCodeContent)
+	result.ETag = []byte("v1")
+
+	request := m.NewCoAPMessage(m.CON, m.GET)
+	request.AddOption(m.OptionEtag, "v0")
+	request.AddOption(m.OptionEtag, "v1")
+	if valid := Validate(request, result); valid.Code != m.CoapCodeValid || valid.Payload.Length() != 0 {
+		t.Errorf("got %v, want 2.03 without payload", valid.Code)
+	}
+
+	request = m.NewCoAPMessage(m.CON, m.GET)
+	request.AddOption(m.OptionEtag, "v0")
+	if valid := Validate(request, result); valid != result {
+		t.Errorf("got %v, want the result unchanged", valid.Code)
+	}
+}
+
+func TestPreconditionsFailed(t *testing.T) {
+	request := m.NewCoAPMessage(m.CON, m.PUT)
+	request.AddOption(m.OptionIfMatch, "v1")
+
+	res := NewCoAPResource(m.CoapMethodPut, "test", nil)
+	if res.PreconditionsFailed(request) {
+		t.Fatal("preconditions evaluated without ETagFunc")
+	}
+
+	etag := []byte("v1")
+	res.ETagFunc(func(*m.CoAPMessage) []byte { return etag })
+	if res.PreconditionsFailed(request) {
+		t.Fatal("If-Match failed for the current ETag")
+	}
+	etag = []byte("v2")
+	if !res.PreconditionsFailed(request) {
+		t.Fatal("If-Match held for another ETag")
+	}
+}
@@ -0,0 +1,293 @@
+package resource
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	cerr "github.com/gusleein/coalago/errors"
+	m "github.com/gusleein/coalago/message"
+)
+
+// WellKnownCore is the path servers expose their resources at (RFC 6690).
+const WellKnownCore = ".well-known/core"
+
+// Attributes describe a resource in CoRE Link Format (RFC 6690).
+type Attributes struct {
+	ResourceType  []string      // rt
+	Interface     []string      // if
+	ContentFormat []m.MediaType // ct
+	Size          int           // sz, 0 if unknown
+	Observable    bool          // obs
+}
+
+func (attrs Attributes) copy() Attributes {
+	attrs.ResourceType = append([]string(nil), attrs.ResourceType...)
+	attrs.Interface = append([]string(nil), attrs.Interface...)
+	attrs.ContentFormat = append([]m.MediaType(nil), attrs.ContentFormat...)
+	return attrs
+}
+
+// Link is a single entry of a CoRE Link Format document.
+type Link struct {
+	Href string
+	Attributes
+}
+
+// Links lists the resources in link format order, one link per path.
+// Templates with parameters or wildcards are not concrete resources and
+// are left out, as is the discovery resource itself.
+func Links(resources []*CoAPResource) []Link {
+	byPath := make(map[string]*Link)
+	var links []*Link
+	for _, res := range resources {
+		if res.Path == WellKnownCore || !isConcretePath(res.Path) {
+			continue
+		}
+		link, ok := byPath[res.Path]
+		if !ok {
+			link = &Link{Href: "/" + res.Path}
+			byPath[res.Path] = link
+			links = append(links, link)
+		}
+		link.merge(res)
+	}
+
+	sort.Slice(links, func(i, j int) bool { return links[i].Href < links[j].Href })
+
+	result := make([]Link, 0, len(links))
+	for _, link := range links {
+		result = append(result, *link)
+	}
+	return result
+}
+
+func isConcretePath(path string) bool {
+	for _, segment := range splitPath(path) {
+		if segment == "*" || isParamSegment(segment) {
+			return false
+		}
+	}
+	return true
+}
+
+// merge adds the attributes of one more method registered for the path.
+func (link *Link) merge(res *CoAPResource) {
+	attrs := res.Attributes()
+	link.ResourceType = appendMissing(link.ResourceType, attrs.ResourceType...)
+	link.Interface = appendMissing(link.Interface, attrs.Interface...)
+
+	contentFormat := attrs.ContentFormat
+	if len(contentFormat) == 0 {
+		contentFormat = res.MediaTypes
+	}
+	for _, ct := range contentFormat {
+		if !containsMediaType(link.ContentFormat, ct) {
+			link.ContentFormat = append(link.ContentFormat, ct)
+		}
+	}
+
+	if attrs.Size > link.Size {
+		link.Size = attrs.Size
+	}
+	link.Observable = link.Observable || attrs.Observable
+}
+
+func appendMissing(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, existing := range list {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func containsMediaType(list []m.MediaType, mt m.MediaType) bool {
+	for _, v := range list {
+		if v == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether the link passes a discovery query filter such as
+// rt=temperature (RFC 6690, section 4.1). A value ending with "*" matches
+// by prefix. An empty name matches every link.
+func (link Link) Match(name, value string) bool {
+	if name == "" {
+		return true
+	}
+
+	var values []string
+	switch name {
+	case "href":
+		values = []string{link.Href}
+	case "rt":
+		values = link.ResourceType
+	case "if":
+		values = link.Interface
+	case "ct":
+		for _, ct := range link.ContentFormat {
+			values = append(values, strconv.Itoa(int(ct)))
+		}
+	case "sz":
+		if link.Size > 0 {
+			values = []string{strconv.Itoa(link.Size)}
+		}
+	case "obs":
+		return link.Observable
+	}
+
+	prefix := strings.HasSuffix(value, "*")
+	value = strings.TrimSuffix(value, "*")
+	for _, v := range values {
+		if v == value || prefix && strings.HasPrefix(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the link, e.g. </sensors/temp>;rt="temperature";ct=0;obs
+func (link Link) String() string {
+	var b strings.Builder
+	b.WriteString("<" + link.Href + ">")
+	if len(link.ResourceType) > 0 {
+		b.WriteString(`;rt="` + strings.Join(link.ResourceType, " ") + `"`)
+	}
+	if len(link.Interface) > 0 {
+		b.WriteString(`;if="` + strings.Join(link.Interface, " ") + `"`)
+	}
+	switch len(link.ContentFormat) {
+	case 0:
+	case 1:
+		b.WriteString(";ct=" + strconv.Itoa(int(link.ContentFormat[0])))
+	default:
+		cts := make([]string, 0, len(link.ContentFormat))
+		for _, ct := range link.ContentFormat {
+			cts = append(cts, strconv.Itoa(int(ct)))
+		}
+		b.WriteString(`;ct="` + strings.Join(cts, " ") + `"`)
+	}
+	if link.Size > 0 {
+		b.WriteString(";sz=" + strconv.Itoa(link.Size))
+	}
+	if link.Observable {
+		b.WriteString(";obs")
+	}
+	return b.String()
+}
+
+// FormatLinks builds a CoRE Link Format document.
+func FormatLinks(links []Link) string {
+	parts := make([]string, 0, len(links))
+	for _, link := range links {
+		parts = append(parts, link.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseLinks parses a CoRE Link Format document. Attributes other than
+// rt, if, ct, sz and obs are skipped.
+func ParseLinks(document string) ([]Link, error) {
+	var links []Link
+	for _, entry := range splitUnquoted(document, ',') {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		params := splitUnquoted(entry, ';')
+		target := strings.TrimSpace(params[0])
+		if len(target) < 2 || target[0] != '<' || target[len(target)-1] != '>' {
+			return nil, cerr.InvalidLinkFormat
+		}
+
+		link := Link{Href: target[1 : len(target)-1]}
+		for _, param := range params[1:] {
+			name, value := param, ""
+			if i := strings.IndexByte(param, '='); i >= 0 {
+				name, value = param[:i], param[i+1:]
+			}
+			name = strings.TrimSpace(name)
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+
+			switch name {
+			case "rt":
+				link.ResourceType = strings.Fields(value)
+			case "if":
+				link.Interface = strings.Fields(value)
+			case "ct":
+				for _, v := range strings.Fields(value) {
+					ct, err := strconv.Atoi(v)
+					if err != nil {
+						return nil, cerr.InvalidLinkFormat
+					}
+					link.ContentFormat = append(link.ContentFormat, m.MediaType(ct))
+				}
+			case "sz":
+				sz, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, cerr.InvalidLinkFormat
+				}
+				link.Size = sz
+			case "obs":
+				link.Observable = true
+			}
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// splitUnquoted splits s by sep outside of double quotes.
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// NewDiscoveryHandler serves the CoRE Link Format document of the
+// resources registered in rt, filtered by a query such as ?rt=temperature.
+func NewDiscoveryHandler(rt *Router) CoAPResourceHandler {
+	return func(message *m.CoAPMessage) *CoAPResourceHandlerResult {
+		var name, value string
+		if queries := message.GetURIQueryArray(); len(queries) > 0 {
+			name = queries[0]
+			if i := strings.IndexByte(name, '='); i >= 0 {
+				name, value = name[:i], name[i+1:]
+			}
+		}
+
+		var links []Link
+		for _, link := range Links(rt.Resources()) {
+			if link.Match(name, value) {
+				links = append(links, link)
+			}
+		}
+
+		result := NewResponse(m.NewStringPayload(FormatLinks(links)), m.CoapCodeContent)
+		result.MediaType = m.MediaTypeApplicationLinkFormat
+		return result
+	}
+}
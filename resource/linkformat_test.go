@@ -0,0 +1,38 @@
+package resource
+
+import (
+	"testing"
+
+	m "github.com/gusleein/coalago/message"
+)
+
+func TestLinkFormatRoundTrip(t *testing.T) {
+	document := `</sensors/light>;rt="light-lux x";ct="0 50",</sensors/temp>;rt="temperature-c";if="sensor";ct=0;sz=10;obs`
+
+	links, err := ParseLinks(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 || links[0].Href != "/sensors/light" || len(links[0].ContentFormat) != 2 || !links[1].Observable || links[1].Size != 10 {
+		t.Fatalf("unexpected links %+v", links)
+	}
+	if FormatLinks(links) != document {
+		t.Fatalf("expected %s, got %s", document, FormatLinks(links))
+	}
+
+	if !links[0].Match("rt", "light*") || links[1].Match("rt", "light*") || !links[1].Match("ct", "0") {
+		t.Fatal("unexpected filtering")
+	}
+}
+
+func TestLinksSkipTemplates(t *testing.T) {
+	router := NewRouter()
+	router.Add(NewCoAPResource(m.CoapMethodGet, "/a", nil)).SetAttributes(Attributes{ResourceType: []string{"x"}})
+	router.Add(NewCoAPResource(m.CoapMethodPut, "/a", nil)).SetAttributes(Attributes{Size: 5})
+	router.Add(NewCoAPResource(m.CoapMethodGet, "/a/{id}", nil))
+	router.Add(NewCoAPResource(m.CoapMethodGet, "/files/*", nil))
+
+	if document := FormatLinks(Links(router.Resources())); document != `</a>;rt="x";sz=5` {
+		t.Fatalf("unexpected document %s", document)
+	}
+}
@@ -0,0 +1,124 @@
+package resource
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	cerr "github.com/gusleein/coalago/errors"
+	m "github.com/gusleein/coalago/message"
+	"github.com/gusleein/coalago/util"
+)
+
+// Encoder turns the Value of a handler result into a payload.
+type Encoder func(value interface{}) (m.CoAPMessagePayload, error)
+
+// Produces declares the media types the resource serves and accepts in
+// request payloads, the first one being the default. A resource without
+// media types takes part in no content negotiation.
+func (res *CoAPResource) Produces(mediaTypes ...m.MediaType) *CoAPResource {
+	for _, mt := range mediaTypes {
+		res.addMediaType(mt)
+	}
+	return res
+}
+
+// Variant registers a handler serving the requests which Accept the media
+// type, instead of the main handler of the resource.
+func (res *CoAPResource) Variant(mediaType m.MediaType, handler CoAPResourceHandler) *CoAPResource {
+	if res.variants == nil {
+		res.variants = make(map[m.MediaType]CoAPResourceHandler)
+	}
+	res.variants[mediaType] = Chain(handler, res.middlewares...)
+	res.addMediaType(mediaType)
+	return res
+}
+
+// Encoder registers how the Value of the results of the resource is
+// encoded when the media type is negotiated.
+func (res *CoAPResource) Encoder(mediaType m.MediaType, encoder Encoder) *CoAPResource {
+	if res.encoders == nil {
+		res.encoders = make(map[m.MediaType]Encoder)
+	}
+	res.encoders[mediaType] = encoder
+	res.addMediaType(mediaType)
+	return res
+}
+
+func (res *CoAPResource) addMediaType(mediaType m.MediaType) {
+	if !containsMediaType(res.MediaTypes, mediaType) {
+		res.MediaTypes = append(res.MediaTypes, mediaType)
+	}
+}
+
+// Negotiate picks the handler for the request and the media type of the
+// response (RFC 7252, section 5.10.4). The code is 4.15 Unsupported
+// Content-Format if the request payload is of a media type the resource
+// does not declare, 4.06 Not Acceptable if the resource cannot produce the
+// media type in the Accept option and 0 otherwise. The media type is -1
+// for resources without declared media types.
+func (res *CoAPResource) Negotiate(message *m.CoAPMessage) (handler CoAPResourceHandler, mediaType m.MediaType, code m.CoapCode) {
+	if len(res.MediaTypes) == 0 {
+		return res.Handler, -1, 0
+	}
+
+	if option := message.GetOption(m.OptionContentFormat); option != nil && message.Payload != nil && message.Payload.Length() > 0 {
+		if !containsMediaType(res.MediaTypes, m.MediaType(option.IntValue())) {
+			return nil, -1, m.CoapCodeUnsupportedContentFormat
+		}
+	}
+
+	mediaType = res.MediaTypes[0]
+	if option := message.GetOption(m.OptionAccept); option != nil {
+		mediaType = m.MediaType(option.IntValue())
+		if !containsMediaType(res.MediaTypes, mediaType) {
+			return nil, -1, m.CoapCodeNotAcceptable
+		}
+	}
+
+	if variant, ok := res.variants[mediaType]; ok {
+		return variant, mediaType, 0
+	}
+	return res.Handler, mediaType, 0
+}
+
+// Render encodes the Value of a successful result with the encoder of the
+// negotiated media type and sets its Content-Format if the handler did not.
+// A result that fails to render is closed.
+func (res *CoAPResource) Render(result *CoAPResourceHandlerResult, mediaType m.MediaType) (*CoAPResourceHandlerResult, error) {
+	if result == nil || mediaType < 0 || result.Code.Group() != "2.xx" {
+		return result, nil
+	}
+
+	rendered := *result
+	if rendered.Payload == nil && rendered.Value != nil {
+		encoder, ok := res.encoders[mediaType]
+		if !ok {
+			result.Close()
+			return nil, cerr.UnsupportedContentFormat
+		}
+		payload, err := encode(encoder, rendered.Value)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		rendered.Payload = payload
+		rendered.MediaType = mediaType
+	}
+	if rendered.MediaType < 0 {
+		rendered.MediaType = mediaType
+	}
+	return &rendered, nil
+}
+
+// encode runs the encoder, recovering from a panic in it like Call does
+// for handlers.
+func encode(encoder Encoder, value interface{}) (payload m.CoAPMessagePayload, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			util.MetricHandlerPanics.Inc()
+			payload, err = nil, fmt.Errorf("encoder panic: %v\n%s", rec, debug.Stack())
+		}
+	}()
+
+	return encoder(value)
+}
@@ -0,0 +1,48 @@
+package resource
+
+import (
+	"testing"
+
+	m "github.com/gusleein/coalago/message"
+)
+
+func TestNegotiate(t *testing.T) {
+	handler := func(*m.CoAPMessage) *CoAPResourceHandlerResult { return nil }
+	res := NewCoAPResource(m.CoapMethodPost, "test", handler).
+		Produces(m.MediaTypeTextPlain).
+		Variant(m.MediaTypeApplicationJSON, handler)
+
+	tests := []struct {
+		contentFormat, accept int
+		mediaType             m.MediaType
+		code                  m.CoapCode
+	}{
+		{-1, -1, m.MediaTypeTextPlain, 0},
+		{-1, int(m.MediaTypeApplicationJSON), m.MediaTypeApplicationJSON, 0},
+		{-1, int(m.MediaTypeApplicationXML), -1, m.CoapCodeNotAcceptable},
+		{int(m.MediaTypeApplicationJSON), -1, m.MediaTypeTextPlain, 0},
+		{int(m.MediaTypeApplicationXML), -1, -1, m.CoapCodeUnsupportedContentFormat},
+	}
+	for i, test := range tests {
+		message := m.NewCoAPMessage(m.CON, m.POST)
+		message.Payload = m.NewStringPayload("x")
+		if test.contentFormat >= 0 {
+			message.AddOption(m.OptionContentFormat, test.contentFormat)
+		}
+		if test.accept >= 0 {
+			message.AddOption(m.OptionAccept, test.accept)
+		}
+		if _, mediaType, code := res.Negotiate(message); mediaType != test.mediaType || code != test.code {
+			t.Errorf("%d: got %d %v, want %d %v", i, mediaType, code, test.mediaType, test.code)
+		}
+	}
+}
+
+func TestRenderRecoversEncoder(t *testing.T) {
+	res := NewCoAPResource(m.CoapMethodGet, "test", nil).
+		Encoder(m.MediaTypeApplicationJSON, func(interface{}) (m.CoAPMessagePayload, error) { panic("boom") })
+
+	if _, err := res.Render(NewValueResponse(1, m.CoapCodeContent), m.MediaTypeApplicationJSON); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -1,9 +1,16 @@
 package resource
 
 import (
+	"fmt"
+	"io"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
 	m "github.com/gusleein/coalago/message"
+	"github.com/gusleein/coalago/util"
+	log "github.com/ndmsystems/golog"
 )
 
 type CoAPResource struct {
@@ -11,22 +18,120 @@ type CoAPResource struct {
 	Path       string
 	Handler    CoAPResourceHandler
 	MediaTypes []m.MediaType
+
+	mx         sync.RWMutex
+	attributes Attributes
+
+	middlewares []Middleware
+	variants    map[m.MediaType]CoAPResourceHandler
+	encoders    map[m.MediaType]Encoder
+	etag        func(*m.CoAPMessage) []byte
+	streams     bool
 }
 
 type CoAPResourceHandlerResult struct {
 	Payload   m.CoAPMessagePayload
 	Code      m.CoapCode
 	MediaType m.MediaType
+
+	// Value is encoded into Payload by the encoder registered for the
+	// negotiated media type, if Payload is nil.
+	Value interface{}
+
+	// ETag identifies the representation, requests that already have it
+	// are answered 2.03 Valid without the payload.
+	ETag []byte
+
+	// Location is the relative URI of the resource a 2.01 Created result
+	// made, e.g. /items/12?rev=3.
+	Location string
+
+	// Options are added to the response, e.g. Max-Age or vendor options.
+	Options []*m.CoAPMessageOption
+
+	// Body, if not nil, is read instead of Payload as the blocks of the
+	// response are sent, see NewBodyResponse. Size is its length in bytes,
+	// announced in Size2.
+	Body io.ReaderAt
+	Size int64
+}
+
+// AddOption adds an option to the response and returns the result, e.g.
+// NewResponse(payload, m.CoapCodeContent).AddOption(m.OptionMaxAge, 30).
+func (res *CoAPResourceHandlerResult) AddOption(code m.OptionCode, value interface{}) *CoAPResourceHandlerResult {
+	res.Options = append(res.Options, m.NewOption(code, value))
+	return res
+}
+
+// SetMaxAge sets how long the response stays fresh in caches.
+func (res *CoAPResourceHandlerResult) SetMaxAge(d time.Duration) *CoAPResourceHandlerResult {
+	return res.AddOption(m.OptionMaxAge, int(d/time.Second))
 }
 
 type CoAPResourceHandler func(message *m.CoAPMessage) *CoAPResourceHandlerResult
 
+// Middleware wraps a handler to run code before and after it, e.g. to
+// authenticate by PeerPublicKey, log requests or collect metrics.
+type Middleware func(next CoAPResourceHandler) CoAPResourceHandler
+
+// Chain wraps handler with middlewares, the first of them being outermost.
+func Chain(handler CoAPResourceHandler, middlewares ...Middleware) CoAPResourceHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Call runs the handler, recovering from a panic in it so that a faulty
+// handler answers 5.00 instead of taking the whole process down.
+func Call(handler CoAPResourceHandler, message *m.CoAPMessage) (result *CoAPResourceHandlerResult, panicked bool) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			util.MetricHandlerPanics.Inc()
+			log.Error(fmt.Sprintf("COALA handler panic: %s %s: %v\n%s", message.Code.String(), message.GetURIPath(), rec, debug.Stack()))
+			result, panicked = nil, true
+		}
+	}()
+
+	return handler(message), false
+}
+
+// Notifier pushes the current representation of an observed resource to
+// its observers (RFC 7641). It is implemented by coalago.Server.
+type Notifier interface {
+	Notify(path string)
+}
+
 func NewResponse(payload m.CoAPMessagePayload, code m.CoapCode) *CoAPResourceHandlerResult {
 	return &CoAPResourceHandlerResult{Payload: payload, Code: code, MediaType: -1} // -1 means no value
 }
 
-func NewCoAPResource(method m.CoapMethod, path string, handler CoAPResourceHandler) *CoAPResource {
-	return &CoAPResource{Method: method, Path: strings.Trim(path, "/ "), Handler: handler}
+// NewValueResponse returns a result whose value is encoded according to
+// the content negotiation, see CoAPResource.Encoder.
+func NewValueResponse(value interface{}, code m.CoapCode) *CoAPResourceHandlerResult {
+	return &CoAPResourceHandlerResult{Value: value, Code: code, MediaType: -1}
+}
+
+func NewCoAPResource(method m.CoapMethod, path string, handler CoAPResourceHandler, middlewares ...Middleware) *CoAPResource {
+	return &CoAPResource{Method: method, Path: strings.Trim(path, "/ "), Handler: Chain(handler, middlewares...), middlewares: middlewares}
+}
+
+// SetAttributes sets the attributes the resource is listed with at
+// /.well-known/core. It may be called while serving.
+func (res *CoAPResource) SetAttributes(attrs Attributes) *CoAPResource {
+	attrs = attrs.copy()
+
+	res.mx.Lock()
+	defer res.mx.Unlock()
+	res.attributes = attrs
+	return res
+}
+
+// Attributes returns a copy of the attributes of the resource.
+func (res *CoAPResource) Attributes() Attributes {
+	res.mx.RLock()
+	defer res.mx.RUnlock()
+	return res.attributes.copy()
 }
 
 /*
@@ -0,0 +1,242 @@
+package resource
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	m "github.com/gusleein/coalago/message"
+)
+
+// Router matches request paths against resource path templates.
+//
+// A template segment is either static ("devices"), a parameter ("{id}")
+// matching exactly one segment, or a trailing wildcard ("*") matching the
+// rest of the path including nothing at all. Segments are compared from
+// left to right and at each position a static segment takes precedence over
+// a parameter, which takes precedence over a wildcard, so
+// "/devices/main/config" wins over "/devices/{id}/config", which wins over
+// "/devices/*".
+type Router struct {
+	mx   sync.RWMutex
+	root *routeNode
+}
+
+type routeNode struct {
+	static    map[string]*routeNode
+	param     *routeNode
+	wildcard  *routeNode
+	resources map[m.CoapMethod]*CoAPResource
+}
+
+func newRouteNode() *routeNode {
+	return &routeNode{
+		static:    make(map[string]*routeNode),
+		resources: make(map[m.CoapMethod]*CoAPResource),
+	}
+}
+
+func NewRouter() *Router {
+	return &Router{root: newRouteNode()}
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/ ")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func isParamSegment(segment string) bool {
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+// Add registers the resource, replacing the one previously registered with
+// the same template and method, and returns it. Add panics if a wildcard is
+// not the last segment of the template.
+func (rt *Router) Add(res *CoAPResource) *CoAPResource {
+	segments := splitPath(res.Path)
+	for i, segment := range segments {
+		if segment == "*" && i != len(segments)-1 {
+			panic(fmt.Sprintf("resource: wildcard in the middle of %q", res.Path))
+		}
+	}
+
+	rt.mx.Lock()
+	defer rt.mx.Unlock()
+
+	node := rt.root
+	for _, segment := range segments {
+		switch {
+		case segment == "*":
+			if node.wildcard == nil {
+				node.wildcard = newRouteNode()
+			}
+			node = node.wildcard
+		case isParamSegment(segment):
+			if node.param == nil {
+				node.param = newRouteNode()
+			}
+			node = node.param
+		default:
+			next, ok := node.static[segment]
+			if !ok {
+				next = newRouteNode()
+				node.static[segment] = next
+			}
+			node = next
+		}
+	}
+	node.resources[res.Method] = res
+	return res
+}
+
+// Match returns the resource registered for the path and method together
+// with the values captured by its parameters. The rest of the path matched
+// by a wildcard is captured under "*".
+func (rt *Router) Match(path string, method m.CoapMethod) (*CoAPResource, map[string]string) {
+	rt.mx.RLock()
+	defer rt.mx.RUnlock()
+
+	segments := splitPath(path)
+	var values []string
+	res := rt.root.match(segments, method, &values)
+	if res == nil {
+		return nil, nil
+	}
+	return res, bindParams(res.Path, segments, values)
+}
+
+// Methods returns the methods registered for templates matching the path.
+func (rt *Router) Methods(path string) []m.CoapMethod {
+	rt.mx.RLock()
+	defer rt.mx.RUnlock()
+
+	found := make(map[m.CoapMethod]bool)
+	rt.root.collect(splitPath(path), found)
+
+	var methods []m.CoapMethod
+	for _, method := range []m.CoapMethod{m.CoapMethodGet, m.CoapMethodPost, m.CoapMethodPut, m.CoapMethodDelete, m.CoapMethodFetch, m.CoapMethodPatch, m.CoapMethodIPatch} {
+		if found[method] {
+			methods = append(methods, method)
+			delete(found, method)
+		}
+	}
+	for method := range found {
+		methods = append(methods, method)
+	}
+	return methods
+}
+
+// Resources returns all registered resources.
+func (rt *Router) Resources() []*CoAPResource {
+	rt.mx.RLock()
+	defer rt.mx.RUnlock()
+
+	var list []*CoAPResource
+	rt.root.walk(func(res *CoAPResource) {
+		list = append(list, res)
+	})
+	return list
+}
+
+func (n *routeNode) match(segments []string, method m.CoapMethod, values *[]string) *CoAPResource {
+	if len(segments) == 0 {
+		if res, ok := n.resources[method]; ok {
+			return res
+		}
+		if n.wildcard != nil {
+			if res, ok := n.wildcard.resources[method]; ok {
+				return res
+			}
+		}
+		return nil
+	}
+
+	if next, ok := n.static[segments[0]]; ok {
+		if res := next.match(segments[1:], method, values); res != nil {
+			return res
+		}
+	}
+
+	if n.param != nil {
+		*values = append(*values, segments[0])
+		if res := n.param.match(segments[1:], method, values); res != nil {
+			return res
+		}
+		*values = (*values)[:len(*values)-1]
+	}
+
+	if n.wildcard != nil {
+		if res, ok := n.wildcard.resources[method]; ok {
+			return res
+		}
+	}
+	return nil
+}
+
+func (n *routeNode) collect(segments []string, found map[m.CoapMethod]bool) {
+	if n.wildcard != nil {
+		for method := range n.wildcard.resources {
+			found[method] = true
+		}
+	}
+	if len(segments) == 0 {
+		for method := range n.resources {
+			found[method] = true
+		}
+		return
+	}
+	if next, ok := n.static[segments[0]]; ok {
+		next.collect(segments[1:], found)
+	}
+	if n.param != nil {
+		n.param.collect(segments[1:], found)
+	}
+}
+
+func (n *routeNode) walk(fn func(*CoAPResource)) {
+	for _, res := range n.resources {
+		fn(res)
+	}
+	for _, next := range n.static {
+		next.walk(fn)
+	}
+	if n.param != nil {
+		n.param.walk(fn)
+	}
+	if n.wildcard != nil {
+		n.wildcard.walk(fn)
+	}
+}
+
+// bindParams names the values captured while matching segments against
+// the template.
+func bindParams(template string, segments []string, values []string) map[string]string {
+	var params map[string]string
+	for i, segment := range splitPath(template) {
+		switch {
+		case segment == "*":
+			if params == nil {
+				params = make(map[string]string)
+			}
+			if i < len(segments) {
+				params["*"] = strings.Join(segments[i:], "/")
+			} else {
+				params["*"] = ""
+			}
+			return params
+		case isParamSegment(segment):
+			if len(values) == 0 {
+				return params
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[segment[1:len(segment)-1]] = values[0]
+			values = values[1:]
+		}
+	}
+	return params
+}
@@ -0,0 +1,77 @@
+package resource
+
+import (
+	"testing"
+
+	m "github.com/gusleein/coalago/message"
+)
+
+func TestRouterPrecedence(t *testing.T) {
+	router := NewRouter()
+	for _, path := range []string{
+		"/devices/main/config",
+		"/devices/{id}/config",
+		"/devices/{id}/{section}",
+		"/files/*",
+		"*",
+	} {
+		router.Add(NewCoAPResource(m.CoapMethodGet, path, nil))
+	}
+
+	cases := []struct {
+		path     string
+		template string
+		params   map[string]string
+	}{
+		{"/devices/main/config", "devices/main/config", nil},
+		{"/devices/42/config", "devices/{id}/config", map[string]string{"id": "42"}},
+		{"/devices/main/status", "devices/{id}/{section}", map[string]string{"id": "main", "section": "status"}},
+		{"/files/a/b.txt", "files/*", map[string]string{"*": "a/b.txt"}},
+		{"/files", "files/*", map[string]string{"*": ""}},
+		{"/other/path", "*", map[string]string{"*": "other/path"}},
+	}
+
+	for _, c := range cases {
+		res, params := router.Match(c.path, m.CoapMethodGet)
+		if res == nil || res.Path != c.template {
+			t.Fatalf("%s: expected template %q, got %v", c.path, c.template, res)
+		}
+		if len(params) != len(c.params) {
+			t.Fatalf("%s: expected params %v, got %v", c.path, c.params, params)
+		}
+		for k, v := range c.params {
+			if params[k] != v {
+				t.Fatalf("%s: expected params %v, got %v", c.path, c.params, params)
+			}
+		}
+	}
+
+	if res, _ := router.Match("/devices/42/config", m.CoapMethodPost); res != nil {
+		t.Fatalf("unexpected match for POST: %v", res.Path)
+	}
+}
+
+func TestRouterFallsBackByMethod(t *testing.T) {
+	router := NewRouter()
+	router.Add(NewCoAPResource(m.CoapMethodGet, "/a/b", nil))
+	router.Add(NewCoAPResource(m.CoapMethodPost, "/a/{x}", nil))
+
+	res, params := router.Match("/a/b", m.CoapMethodPost)
+	if res == nil || res.Path != "a/{x}" || params["x"] != "b" {
+		t.Fatalf("expected a/{x} to match, got %v %v", res, params)
+	}
+
+	methods := router.Methods("/a/b")
+	if len(methods) != 2 || methods[0] != m.CoapMethodGet || methods[1] != m.CoapMethodPost {
+		t.Fatalf("unexpected methods %v", methods)
+	}
+}
+
+func TestRouterRejectsInnerWildcard(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	NewRouter().Add(NewCoAPResource(m.CoapMethodGet, "/a/*/b", nil))
+}
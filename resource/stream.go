@@ -0,0 +1,49 @@
+package resource
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	m "github.com/gusleein/coalago/message"
+)
+
+// CoAPResourceStreamHandler gets the payload of a request as body, fed
+// block by block while a Block1 transfer goes on, so that an upload can be
+// written to disk or hashed without holding it in memory. A handler reading
+// slowly slows the sender down.
+type CoAPResourceStreamHandler func(message *m.CoAPMessage, body io.Reader) *CoAPResourceHandlerResult
+
+// NewCoAPStreamResource returns a resource whose handler reads the payload
+// from a stream, see CoAPResourceStreamHandler.
+func NewCoAPStreamResource(method m.CoapMethod, path string, handler CoAPResourceStreamHandler, middlewares ...Middleware) *CoAPResource {
+	return &CoAPResource{
+		Method:      method,
+		Path:        strings.Trim(path, "/ "),
+		Handler:     Chain(streamHandler(handler), middlewares...),
+		middlewares: middlewares,
+		streams:     true,
+	}
+}
+
+// Streams reports whether the resource takes block-wise requests as they
+// arrive instead of reassembled.
+func (resource *CoAPResource) Streams() bool {
+	return resource.streams
+}
+
+func streamHandler(handler CoAPResourceStreamHandler) CoAPResourceHandler {
+	return func(message *m.CoAPMessage) *CoAPResourceHandlerResult {
+		body := message.Body
+		if body == nil {
+			body = bytes.NewReader(message.Payload.Bytes())
+		}
+		result := handler(message, body)
+
+		// the response answers the last block, so the rest of the request
+		// is received even if the handler did not need it
+		io.Copy(ioutil.Discard, body)
+		return result
+	}
+}
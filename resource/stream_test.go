@@ -0,0 +1,36 @@
+package resource
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	m "github.com/gusleein/coalago/message"
+)
+
+func TestStreamHandler(t *testing.T) {
+	var got string
+	res := NewCoAPStreamResource(m.CoapMethodPost, "/up", func(message *m.CoAPMessage, body io.Reader) *CoAPResourceHandlerResult {
+		b, _ := ioutil.ReadAll(io.LimitReader(body, 3))
+		got = string(b)
+		return NewResponse(nil, m.CoapCodeChanged)
+	})
+	if !res.Streams() {
+		t.Fatal("resource does not stream")
+	}
+
+	request := m.NewCoAPMessage(m.CON, m.POST)
+	request.Payload = m.NewStringPayload("whole")
+	res.Handler(request)
+	if got != "who" {
+		t.Errorf("payload: got %q", got)
+	}
+
+	body := strings.NewReader("streamed")
+	request.Body = body
+	res.Handler(request)
+	if got != "str" || body.Len() != 0 {
+		t.Errorf("body: got %q, %d bytes left", got, body.Len())
+	}
+}
@@ -0,0 +1,134 @@
+package coalago
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	m "github.com/gusleein/coalago/message"
+)
+
+type Response struct {
+	Body          []byte
+	Code          m.CoapCode
+	MediaType     m.MediaType // Content-Format of Body, -1 if not given
+	Options       []*m.CoAPMessageOption
+	PeerPublicKey []byte
+
+	RemoteAddr  net.Addr
+	RTT         time.Duration // from sending the request to receiving the whole response
+	Retransmits int           // messages sent again during the exchange
+
+	base *url.URL // scheme and host of the request
+}
+
+func newResponse(message *m.CoAPMessage) *Response {
+	r := new(Response)
+	r.Body = message.Payload.Bytes()
+	r.Code = message.Code
+	r.MediaType = -1
+	if option := message.GetOption(m.OptionContentFormat); option != nil {
+		r.MediaType = m.MediaType(option.IntValue())
+	}
+	r.Options = message.Options
+	r.PeerPublicKey = message.PeerPublicKey
+	r.RemoteAddr = message.Sender
+	return r
+}
+
+// Decode unmarshals the body into v by its Content-Format, see m.Unmarshal.
+func (r *Response) Decode(v interface{}) error {
+	return m.Unmarshal(r.MediaType, r.Body, v)
+}
+
+// Option returns the first option with the code or nil.
+func (r *Response) Option(code m.OptionCode) *m.CoAPMessageOption {
+	for _, option := range r.Options {
+		if option.Code == code {
+			return option
+		}
+	}
+	return nil
+}
+
+func (r *Response) options(code m.OptionCode) []string {
+	var values []string
+	for _, option := range r.Options {
+		if option.Code == code {
+			values = append(values, option.StringValue())
+		}
+	}
+	return values
+}
+
+// ETag returns the entity tag of the representation or nil.
+func (r *Response) ETag() []byte {
+	if option := r.Option(m.OptionEtag); option != nil {
+		return []byte(option.StringValue())
+	}
+	return nil
+}
+
+// MaxAge returns how long the response stays fresh, 60 seconds if the
+// server did not say.
+func (r *Response) MaxAge() time.Duration {
+	if option := r.Option(m.OptionMaxAge); option != nil {
+		return time.Duration(option.Uint32Value()) * time.Second
+	}
+	return defaultMaxAge
+}
+
+// LocationPath returns the path of a resource created by the request,
+// e.g. /items/12, or "" if there is none.
+func (r *Response) LocationPath() string {
+	segments := r.options(m.OptionLocationPath)
+	if len(segments) == 0 {
+		return ""
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// Location returns the URI of the resource the request created, built from
+// Location-Path and Location-Query, or nil if the server gave none.
+func (r *Response) Location() *url.URL {
+	path := r.LocationPath()
+	queries := r.options(m.OptionLocationQuery)
+	if path == "" && len(queries) == 0 {
+		return nil
+	}
+
+	location := new(url.URL)
+	if r.base != nil {
+		location.Scheme, location.Host = r.base.Scheme, r.base.Host
+	}
+	location.Path = path
+	if location.Path == "" {
+		location.Path = "/"
+	}
+	for i, q := range queries {
+		queries[i] = url.QueryEscape(q)
+		if j := strings.IndexByte(q, '='); j >= 0 {
+			queries[i] = url.QueryEscape(q[:j]) + "=" + url.QueryEscape(q[j+1:])
+		}
+	}
+	location.RawQuery = strings.Join(queries, "&")
+	return location
+}
+
+// Observe returns the sequence number of a notification.
+func (r *Response) Observe() (seq int, ok bool) {
+	if option := r.Option(m.OptionObserve); option != nil {
+		return option.IntValue(), true
+	}
+	return 0, false
+}
+
+// Size2 returns the size of the whole representation if the server
+// announced it.
+func (r *Response) Size2() (size int, ok bool) {
+	if option := r.Option(m.OptionSize2); option != nil {
+		return option.IntValue(), true
+	}
+	return 0, false
+}
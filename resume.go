@@ -0,0 +1,273 @@
+package coalago
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	cerr "github.com/gusleein/coalago/errors"
+	m "github.com/gusleein/coalago/message"
+	"github.com/gusleein/coalago/util"
+	"github.com/patrickmn/go-cache"
+)
+
+// Transfer records how far an upload or a download got, so that it can go
+// on from there after an interruption such as cerr.MaxAttempts. It can be
+// saved along with the data, e.g. as JSON, to resume after a restart.
+type Transfer struct {
+	// ID is the Request-Tag (RFC 9175) of the blocks of an upload or the
+	// ETag of the representation being downloaded.
+	ID []byte
+
+	// Offset is the number of bytes acknowledged by the server (upload)
+	// or written (download) in a row from the start.
+	Offset int64
+
+	// BlockSize is the size of the blocks Offset is made of.
+	BlockSize int
+}
+
+// UploadResumable is Upload going on from t.Offset of body after an attempt
+// with the same t was interrupted, the server keeping the blocks it got,
+// see WithUploadRetention. The blocks carry t.ID as Request-Tag and the
+// size of body as Size1, a resumed upload sends them from the number of the
+// block at t.Offset on. A new Transfer starts from the beginning, so does a
+// resumed one the server answers 4.08 Request Entity Incomplete, having no
+// blocks for it anymore. t is kept up to date, also when the upload fails.
+func (c *Client) UploadResumable(ctx context.Context, url string, t *Transfer, body io.ReadSeeker, size int64, options ...*m.CoAPMessageOption) (*Response, error) {
+	if t.ID == nil {
+		t.ID = m.GenerateToken(8)
+	}
+	if t.BlockSize != c.cfg.blockSize || t.Offset >= size {
+		t.Offset, t.BlockSize = 0, c.cfg.blockSize
+	}
+
+	for {
+		message, err := constructMessage(m.POST, url)
+		if err != nil {
+			return nil, err
+		}
+		message.AddOptions(options)
+		message.AddOption(m.OptionRequestTag, t.ID)
+		message.AddOption(m.OptionSize1, int(size))
+		message.Context = ctx
+
+		first := int(t.Offset) / t.BlockSize
+		if _, err = body.Seek(int64(first*t.BlockSize), io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		stream := &transfer{body: body, size: size, first: first, offset: int64(first * t.BlockSize)}
+		resp, err := c.exchange(message, message.Recipient.String(), stream)
+		t.Offset = stream.offset
+		if err != nil {
+			return nil, err
+		}
+		if resp.Code == m.CoapCodeRequestEntityIncomplete && first > 0 {
+			t.Offset = 0
+			continue
+		}
+		t.Offset = size
+		return resp, nil
+	}
+}
+
+// DownloadResumable is Download going on from t.Offset after an attempt
+// with the same t was interrupted, w being where the attempt left off, e.g.
+// a file opened for appending. The blocks from there are asked for with
+// Block2. If the representation is not the one the attempt began with, as
+// told by its ETag, or has no ETag, cerr.TransferChanged is returned and the
+// download has to start over with a new Transfer. t is kept up to date, also when the
+// download fails.
+func (c *Client) DownloadResumable(ctx context.Context, url string, t *Transfer, w io.Writer, progress ProgressFunc, options ...*m.CoAPMessageOption) (*Response, error) {
+	message, err := constructMessage(m.GET, url)
+	if err != nil {
+		return nil, err
+	}
+	message.AddOptions(options)
+	message.Context = ctx
+
+	stream := &transfer{output: w, progress: progress, etag: t.ID, blockSize: t.BlockSize, offset: t.Offset}
+	if t.Offset > 0 && t.BlockSize > 0 {
+		stream.first = int(t.Offset) / t.BlockSize
+		message.AddOption(m.OptionBlock2, util.NewBlock(false, stream.first, t.BlockSize).ToInt())
+	}
+
+	resp, err := c.exchange(message, message.Recipient.String(), stream)
+	t.ID, t.Offset, t.BlockSize = stream.etag, stream.offset, stream.blockSize
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code.Group() != "2.xx" {
+		return resp, cerr.UnexpectedResponseCode
+	}
+
+	// a representation fitting into a single message is not streamed
+	if len(resp.Body) > 0 {
+		if stream.first > 0 {
+			return nil, cerr.TransferChanged
+		}
+		if _, err = w.Write(resp.Body); err != nil {
+			return nil, err
+		}
+		t.Offset = int64(len(resp.Body))
+		if progress != nil {
+			progress(t.Offset, t.Offset)
+		}
+		resp.Body = nil
+	}
+	return resp, nil
+}
+
+// check makes sure a block belongs to the representation the transfer
+// began with and records its ETag and block size.
+func (t *transfer) check(message *m.CoAPMessage, block *util.Block) error {
+	var etag []byte
+	if option := message.GetOption(m.OptionEtag); option != nil {
+		etag = []byte(option.StringValue())
+	}
+	// without ETags nothing tells the representation is the same one
+	if t.first > 0 && (etag == nil || t.etag == nil || !bytes.Equal(etag, t.etag) || block.BlockSize != t.blockSize) {
+		return cerr.TransferChanged
+	}
+	t.etag, t.blockSize = etag, block.BlockSize
+	return nil
+}
+
+// uploadStore keeps the blocks of uploads tagged with Request-Tag until the
+// retention time passes after the last of them. Only uploads announcing
+// their size in Size1 are kept, as long as the sizes add up to no more than
+// maxSize.
+type uploadStore struct {
+	mx      sync.Mutex
+	uploads *cache.Cache
+	maxSize int64
+}
+
+type partialUpload struct {
+	mx     sync.Mutex
+	key    string
+	size   int64 // announced in Size1
+	stored int64
+	total  int
+	blocks map[int][]byte
+}
+
+func newUploadStore(retention time.Duration, maxSize int64) *uploadStore {
+	return &uploadStore{uploads: cache.New(retention, time.Second), maxSize: maxSize}
+}
+
+// partialUploadKey identifies an upload by its Request-Tag, as the client
+// may come back from another port.
+func partialUploadKey(message *m.CoAPMessage) string {
+	return fmt.Sprintf("%x %s %s %x", message.GetOption(m.OptionRequestTag).StringValue(),
+		message.Code.String(), message.GetURIPath(), message.PeerPublicKey)
+}
+
+func isTaggedBlock1(message *m.CoAPMessage) bool {
+	return message.Type == m.CON && message.GetBlock1() != nil && message.GetOption(m.OptionRequestTag) != nil
+}
+
+// open returns the upload the first tagged block of an exchange belongs
+// to, nil if the upload is not kept. ok is false if the block goes on from
+// blocks that are not kept, which is answered 4.08 Request Entity
+// Incomplete (RFC 7959, section 2.9.2).
+func (s *uploadStore) open(message *m.CoAPMessage) (upload *partialUpload, ok bool) {
+	first := message.GetBlock1().BlockNumber
+	if s == nil {
+		return nil, first == 0
+	}
+
+	key := partialUploadKey(message)
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if v, found := s.uploads.Get(key); found {
+		upload = v.(*partialUpload)
+		if !upload.has(first) {
+			return nil, false
+		}
+		return upload, true
+	}
+	if first > 0 {
+		return nil, false
+	}
+
+	size := int64(-1)
+	if option := message.GetOption(m.OptionSize1); option != nil {
+		size = int64(option.IntValue())
+	}
+	if size < 0 || s.reserved()+size > s.maxSize {
+		return nil, true
+	}
+
+	upload = &partialUpload{key: key, size: size, total: -1, blocks: make(map[int][]byte)}
+	s.uploads.SetDefault(key, upload)
+	return upload, true
+}
+
+// reserved is the size of the uploads kept.
+func (s *uploadStore) reserved() int64 {
+	var size int64
+	for _, item := range s.uploads.Items() {
+		size += item.Object.(*partialUpload).size
+	}
+	return size
+}
+
+// keep restarts the retention time of the upload.
+func (s *uploadStore) keep(upload *partialUpload) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	// unless expired and started over meanwhile
+	if v, found := s.uploads.Get(upload.key); !found || v == upload {
+		s.uploads.SetDefault(upload.key, upload)
+	}
+}
+
+func (s *uploadStore) drop(upload *partialUpload) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if v, found := s.uploads.Get(upload.key); found && v == upload {
+		s.uploads.Delete(upload.key)
+	}
+}
+
+// has reports whether the blocks before n are all there.
+func (u *partialUpload) has(n int) bool {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	for i := 0; i < n; i++ {
+		if _, ok := u.blocks[i]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// receive stores a block like localStateReceiveARQBlock1 and returns the
+// request with the whole payload once the last block missing arrives. fits
+// is false if the block goes beyond the size the upload announced.
+func (u *partialUpload) receive(tr *transport, message *m.CoAPMessage) (request *m.CoAPMessage, done, fits bool) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	payload := message.Payload.Bytes()
+	if _, ok := u.blocks[message.GetBlock1().BlockNumber]; !ok {
+		if u.stored+int64(len(payload)) > u.size {
+			return nil, false, false
+		}
+		u.stored += int64(len(payload))
+	}
+
+	ok, total, blocks, message, err := localStateReceiveARQBlock1(tr, u.total, u.blocks, message)
+	u.total, u.blocks = total, blocks
+	return message, ok && err == nil, true
+}
@@ -0,0 +1,80 @@
+package coalago
+
+import (
+	"testing"
+	"time"
+
+	cerr "github.com/gusleein/coalago/errors"
+	m "github.com/gusleein/coalago/message"
+	"github.com/gusleein/coalago/util"
+)
+
+func TestUploadStoreOpen(t *testing.T) {
+	block := func(num int, size int) *m.CoAPMessage {
+		message := m.NewCoAPMessage(m.CON, m.POST)
+		message.SetURIPath("/upload")
+		message.AddOption(m.OptionRequestTag, []byte("tag"))
+		message.AddOption(m.OptionBlock1, util.NewBlock(true, num, 16).ToInt())
+		if size >= 0 {
+			message.AddOption(m.OptionSize1, size)
+		}
+		return message
+	}
+
+	var disabled *uploadStore
+	if upload, ok := disabled.open(block(0, 64)); upload != nil || !ok {
+		t.Fatal("upload kept without retention")
+	}
+	if _, ok := disabled.open(block(1, 64)); ok {
+		t.Fatal("resumed without retention")
+	}
+
+	s := newUploadStore(time.Minute, 100)
+	if _, ok := s.open(block(1, 64)); ok {
+		t.Fatal("resumed an upload never started")
+	}
+	if upload, ok := s.open(block(0, -1)); upload != nil || !ok {
+		t.Fatal("upload of unknown size kept")
+	}
+	if upload, ok := s.open(block(0, 200)); upload != nil || !ok {
+		t.Fatal("upload beyond the limit kept")
+	}
+
+	upload, ok := s.open(block(0, 64))
+	if upload == nil || !ok {
+		t.Fatal("upload not kept")
+	}
+	if _, ok := s.open(block(1, 64)); ok {
+		t.Fatal("resumed after a block not received")
+	}
+	upload.blocks[0] = []byte("a")
+	if resumed, ok := s.open(block(1, 64)); resumed != upload || !ok {
+		t.Fatal("resumed upload not found")
+	}
+	if other, _ := s.open(block(0, 64)); other != upload {
+		t.Fatal("restarted upload not found")
+	}
+}
+
+func TestTransferCheck(t *testing.T) {
+	block := util.NewBlock(true, 3, 512)
+	tests := []struct {
+		etag, got []byte
+		err       error
+	}{
+		{[]byte("e1"), []byte("e1"), nil},
+		{[]byte("e1"), []byte("e2"), cerr.TransferChanged},
+		{nil, nil, cerr.TransferChanged},
+		{[]byte("e1"), nil, cerr.TransferChanged},
+	}
+	for i, test := range tests {
+		message := m.NewCoAPMessage(m.ACK, m.CoapCodeContent)
+		if test.got != nil {
+			message.AddOption(m.OptionEtag, string(test.got))
+		}
+		stream := &transfer{first: 3, blockSize: 512, etag: test.etag}
+		if err := stream.check(message, block); err != test.err {
+			t.Errorf("%d: got %v, want %v", i, err, test.err)
+		}
+	}
+}
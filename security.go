@@ -64,13 +64,13 @@ func getProxyIDIfNeed(proxyAddr string, senderAddr string) (uint32, bool) {
 func getSessionForAddress(tr *transport, senderAddr, receiverAddr, proxyAddr string) (session.SecuredSession, bool) {
 	securedSession, ok := globalSessions.Get(senderAddr, receiverAddr, proxyAddr)
 	if ok {
-		globalSessions.Set(senderAddr, receiverAddr, proxyAddr, securedSession)
+		globalSessions.Set(senderAddr, receiverAddr, proxyAddr, securedSession, tr.cfg.sessionExpiration)
 	}
 	return securedSession, ok
 }
 
-func setSessionForAddress(privatekey []byte, securedSession session.SecuredSession, senderAddr, receiverAddr, proxyAddr string) {
-	globalSessions.Set(senderAddr, receiverAddr, proxyAddr, securedSession)
+func setSessionForAddress(tr *transport, securedSession session.SecuredSession, senderAddr, receiverAddr, proxyAddr string) {
+	globalSessions.Set(senderAddr, receiverAddr, proxyAddr, securedSession, tr.cfg.sessionExpiration)
 	util.MetricSessionsRate.Inc()
 	util.MetricSessionsCount.Set(int64(globalSessions.ItemCount()))
 }
@@ -173,7 +173,7 @@ func receiveHandshake(tr *transport, privatekey []byte, message *m.CoAPMessage,
 		util.MetricSuccessfulHandhshakes.Inc()
 
 		peerSession.UpdatedAt = int(time.Now().Unix())
-		setSessionForAddress(privatekey, peerSession, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
+		setSessionForAddress(tr, peerSession, tr.conn.LocalAddr().String(), message.Sender.String(), proxyAddr)
 		return false, nil
 	}
 
@@ -212,7 +212,7 @@ func handshake(tr *transport, message *m.CoAPMessage, address net.Addr, proxyAdd
 		return session.SecuredSession{}, err
 	}
 
-	globalSessions.Set(tr.conn.LocalAddr().String(), address.String(), proxyAddr, ses)
+	globalSessions.Set(tr.conn.LocalAddr().String(), address.String(), proxyAddr, ses, tr.cfg.sessionExpiration)
 	util.MetricSuccessfulHandhshakes.Inc()
 
 	return ses, nil
@@ -254,6 +254,7 @@ func newClientHelloMessage(origMessage *m.CoAPMessage, myPublicKey []byte) *m.Co
 	message.Token = m.GenerateToken(6)
 	message.CloneOptions(origMessage, m.OptionProxyURI, m.OptionProxySecurityID)
 	message.ProxyAddr = origMessage.ProxyAddr
+	message.Context = origMessage.Context
 	return message
 }
 
@@ -0,0 +1,161 @@
+package coalago
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	cerr "github.com/gusleein/coalago/errors"
+	m "github.com/gusleein/coalago/message"
+	r "github.com/gusleein/coalago/resource"
+	"github.com/gusleein/coalago/util"
+)
+
+// Respond delivers the result for a request answered earlier with an empty
+// ACK (RFC 7252, section 5.2.2) by a handler that returned nil under
+// NilResultSeparateResponse. The result is sent as a confirmable message
+// with the token of the request and retransmitted until acknowledged.
+func (s *Server) Respond(request *m.CoAPMessage, result *r.CoAPResourceHandlerResult) error {
+	s.mx.Lock()
+	sr := s.sr
+	s.mx.Unlock()
+	if sr == nil {
+		return cerr.NilConn
+	}
+	if result == nil {
+		return cerr.NilMessage
+	}
+	defer result.Close()
+
+	return s.respond(sr, r.ResponseMessage(request, result), request.Sender)
+}
+
+func (s *Server) respond(sr *transport, responseMessage *m.CoAPMessage, addr net.Addr) error {
+	// large results go out as a Block2 transfer, which is confirmable
+	// block by block already
+	if sr.isBigPayload(responseMessage) {
+		_, err := sr.SendTo(responseMessage, addr)
+		return err
+	}
+	if responseMessage.Body != nil {
+		if err := readBody(responseMessage); err != nil {
+			return err
+		}
+	}
+
+	responseMessage.Type = m.CON
+	responseMessage.MessageID = m.NewCoAPMessage(m.CON, responseMessage.Code).MessageID
+	responseMessage.RemoveOptions(m.OptionBlock1)
+	if !s.sendConfirmable(sr, responseMessage, addr) {
+		return cerr.MaxAttempts
+	}
+	return nil
+}
+
+// confirm hands an ACK or RST over to the confirmable message it answers.
+// Returns false if the message is not a reply to a pending message.
+func (s *Server) confirm(message *m.CoAPMessage) bool {
+	if message.Type != m.ACK && message.Type != m.RST {
+		return false
+	}
+	ch, ok := s.confirmations.Load(message.Sender.String() + message.GetMessageIDString())
+	if !ok {
+		return false
+	}
+	select {
+	case ch.(chan *m.CoAPMessage) <- message:
+	default:
+	}
+	return true
+}
+
+// sendConfirmable transmits a CON message initiated by the server until it
+// is acknowledged. Returns false if the peer rejected it or never answered.
+func (s *Server) sendConfirmable(sr *transport, message *m.CoAPMessage, addr net.Addr) bool {
+	key := addr.String() + message.GetMessageIDString()
+	ch := make(chan *m.CoAPMessage, 1)
+	s.confirmations.Store(key, ch)
+	defer s.confirmations.Delete(key)
+
+	for attempts := 0; attempts < s.cfg.maxSendAttempts; attempts++ {
+		if attempts > 0 {
+			util.MetricRetransmitMessages.Inc()
+		}
+		if err := sr.sendToSocketByAddress(message, addr); err != nil {
+			return false
+		}
+
+		select {
+		case reply := <-ch:
+			return reply.Type == m.ACK
+		case <-time.After(s.cfg.timeWait):
+		}
+	}
+
+	util.MetricExpiredMessages.Inc()
+	return false
+}
+
+func emptyACK(sr *transport, message *m.CoAPMessage) bool {
+	responseMessage := m.NewCoAPMessageId(m.ACK, m.CoapCodeEmpty, message.MessageID)
+	responseMessage.Token = message.Token
+	responseMessage.Payload = m.NewEmptyPayload()
+	if message.GetScheme() == m.COAPS_SCHEME {
+		responseMessage.SetSchemeCOAPS()
+	}
+	responseMessage.CloneOptions(message, m.OptionProxySecurityID)
+
+	_, err := sr.SendTo(responseMessage, message.Sender)
+	return err != nil
+}
+
+// callHandlerSeparately runs the handler like r.Call. If the handler
+// keeps a confirmable request longer than the separate response threshold,
+// the request is acknowledged with an empty ACK right away, so that the
+// client stops retransmitting, and the result has to be returned as a
+// separate response. A streamed request is never separated, its blocks are
+// still coming.
+func callHandlerSeparately(sr *transport, handler r.CoAPResourceHandler, message *m.CoAPMessage) (result *r.CoAPResourceHandlerResult, panicked, separated bool) {
+	if message.Type != m.CON || sr.cfg.separateResponseAfter <= 0 || message.Body != nil {
+		result, panicked = r.Call(handler, message)
+		return
+	}
+
+	var mx sync.Mutex
+	done := false
+	timer := time.AfterFunc(sr.cfg.separateResponseAfter, func() {
+		mx.Lock()
+		defer mx.Unlock()
+		if !done {
+			separated = true
+			emptyACK(sr, message)
+		}
+	})
+
+	result, panicked = r.Call(handler, message)
+	timer.Stop()
+
+	mx.Lock()
+	done = true
+	mx.Unlock()
+	return
+}
+
+func returnSeparateResult(rs Resourcer, sr *transport, message *m.CoAPMessage, handlerResult *r.CoAPResourceHandlerResult, panicked bool) bool {
+	switch {
+	case panicked:
+		handlerResult = r.NewResponse(m.NewStringPayload("Resource handler failed"), m.CoapCodeInternalServerError)
+	case handlerResult == nil:
+		if rs.nilResultPolicy() == NilResultSeparateResponse {
+			return false
+		}
+		handlerResult = r.NewResponse(m.NewStringPayload("No Result was returned by Resource Handler"), m.CoapCodeInternalServerError)
+	}
+
+	responseMessage := r.ResponseMessage(message, handlerResult)
+	if seq, ok := rs.observe(message, handlerResult.Code); ok {
+		responseMessage.AddOption(m.OptionObserve, seq)
+	}
+
+	return rs.respond(sr, responseMessage, message.Sender) != nil
+}
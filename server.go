@@ -1,11 +1,12 @@
 package coalago
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"strings"
 	"sync"
 
+	cerr "github.com/gusleein/coalago/errors"
 	m "github.com/gusleein/coalago/message"
 	r "github.com/gusleein/coalago/resource"
 	log "github.com/ndmsystems/golog"
@@ -16,25 +17,49 @@ type rawData struct {
 	sender net.Addr
 }
 
+// ErrServerClosed is returned by Server.Listen after a call to Shutdown.
+var ErrServerClosed = cerr.ServerClosed
+
 type Server struct {
 	proxyEnable bool
 	sr          *transport
-	resources   sync.Map
+	router      *r.Router
 	privatekey  []byte
-}
+	cfg         *config
 
-func NewServer() *Server {
-	return new(Server)
+	mx         sync.Mutex
+	inShutdown bool
+	inFlight   sync.WaitGroup
+
+	observers     *observeRegistry
+	middlewares   []r.Middleware
+	confirmations sync.Map
 }
 
-func NewServerWithPrivateKey(privatekey []byte) *Server {
+func NewServer(opts ...Option) *Server {
 	s := new(Server)
+	s.cfg = newConfig(opts)
+	s.observers = newObserveRegistry()
+	s.router = r.NewRouter()
+	s.router.Add(r.NewCoAPResource(m.CoapMethodGet, r.WellKnownCore, r.NewDiscoveryHandler(s.router)))
+	return s
+}
+
+func NewServerWithPrivateKey(privatekey []byte, opts ...Option) *Server {
+	s := NewServer(opts...)
 	s.privatekey = privatekey
 	return s
 }
 
 type Resourcer interface {
-	getResourceForPathAndMethod(path string, method m.CoapMethod) *r.CoAPResource
+	getResourceForPathAndMethod(path string, method m.CoapMethod) (*r.CoAPResource, map[string]string)
+	getMethodsForPath(path string) []m.CoapMethod
+	withMiddlewares(handler r.CoAPResourceHandler) r.CoAPResourceHandler
+	acquireHandler() bool
+	releaseHandler()
+	observe(message *m.CoAPMessage, code m.CoapCode) (seq int, ok bool)
+	nilResultPolicy() NilResultPolicy
+	respond(sr *transport, responseMessage *m.CoAPMessage, addr net.Addr) error
 }
 
 func (s *Server) Listen(addr string) (err error) {
@@ -43,17 +68,28 @@ func (s *Server) Listen(addr string) (err error) {
 		return err
 	}
 
-	s.sr = newtransport(conn)
+	s.mx.Lock()
+	if s.inShutdown {
+		s.mx.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.sr = newtransport(conn, s.cfg)
 	s.sr.privateKey = s.privatekey
+	s.mx.Unlock()
+
 	log.Info(fmt.Sprintf(
 		"COALAServer start ADDR: %s, WS: %d, MinWS: %d, MaxWS: %d, Retransmit:%d, timeWait:%d, poolExpiration:%d",
-		addr, DEFAULT_WINDOW_SIZE, MIN_WiNDOW_SIZE, MAX_WINDOW_SIZE, maxSendAttempts, timeWait, SESSIONS_POOL_EXPIRATION))
+		addr, s.cfg.windowSize, s.cfg.minWindowSize, s.cfg.maxWindowSize, s.cfg.maxSendAttempts, s.cfg.timeWait, s.cfg.sessionExpiration))
 	for {
 		readBuf := make([]byte, MTU+1)
 	start:
 		n, senderAddr, err := s.sr.conn.Listen(readBuf)
 		if err != nil {
-			panic(err)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
 		}
 		if n == 0 {
 			goto start
@@ -64,14 +100,21 @@ func (s *Server) Listen(addr string) (err error) {
 			goto start
 		}
 
+		if s.confirm(message) {
+			goto start
+		}
+
 		id := senderAddr.String() + message.GetTokenString()
 		fn, ok := StorageLocalStates.Get(id)
 		if !ok {
+			if s.shuttingDown() {
+				goto start
+			}
 			fn = MakeLocalStateFn(s, s.sr, nil, func() {
 				StorageLocalStates.Delete(id)
 			})
 		}
-		StorageLocalStates.SetDefault(id, fn)
+		StorageLocalStates.Set(id, fn, s.cfg.sumTimeAttempts())
 
 		go fn.(LocalStateFn)(message)
 	}
@@ -80,57 +123,176 @@ func (s *Server) Listen(addr string) (err error) {
 func (s *Server) Serve(conn *net.UDPConn) {
 	c := new(connection)
 	c.conn = conn
-	s.sr = newtransport(c)
+	s.sr = newtransport(c, s.cfg)
 	s.sr.privateKey = s.privatekey
 
 }
 
 func (s *Server) ServeMessage(message *m.CoAPMessage) {
+	if s.confirm(message) {
+		return
+	}
+
 	id := message.Sender.String() + message.GetTokenString()
 	fn, ok := StorageLocalStates.Get(id)
 	if !ok {
+		if s.shuttingDown() {
+			return
+		}
 		fn = MakeLocalStateFn(s, s.sr, nil, func() {
 			StorageLocalStates.Delete(id)
 		})
-		StorageLocalStates.SetDefault(id, fn)
+		StorageLocalStates.Set(id, fn, s.cfg.sumTimeAttempts())
 	}
 
 	go fn.(LocalStateFn)(message)
 }
 
-func (s *Server) addResource(res *r.CoAPResource) {
-	key := res.Path + fmt.Sprint(res.Method)
-	s.resources.Store(key, res)
-}
+// Shutdown stops accepting new exchanges and waits until in-flight handlers
+// and the block-wise transfers of their responses are finished or ctx is
+// done, whichever comes first. Then it closes the socket, so that Listen
+// returns ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mx.Lock()
+	s.inShutdown = true
+	sr := s.sr
+	s.mx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
 
-func (s *Server) GET(path string, handler r.CoAPResourceHandler) {
-	s.addResource(r.NewCoAPResource(m.CoapMethodGet, path, handler))
+	if sr != nil {
+		sr.conn.Close()
+	}
+	return err
 }
 
-func (s *Server) POST(path string, handler r.CoAPResourceHandler) {
-	s.addResource(r.NewCoAPResource(m.CoapMethodPost, path, handler))
+func (s *Server) shuttingDown() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.inShutdown
 }
 
-func (s *Server) AddPUTResource(path string, handler r.CoAPResourceHandler) {
-	s.addResource(r.NewCoAPResource(m.CoapMethodPut, path, handler))
+func (s *Server) acquireHandler() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.inShutdown {
+		return false
+	}
+	s.inFlight.Add(1)
+	return true
 }
 
-func (s *Server) DELETE(path string, handler r.CoAPResourceHandler) {
-	s.addResource(r.NewCoAPResource(m.CoapMethodDelete, path, handler))
+func (s *Server) releaseHandler() {
+	s.inFlight.Done()
 }
 
-func (s *Server) getResourceForPathAndMethod(path string, method m.CoapMethod) *r.CoAPResource {
-	path = strings.Trim(path, "/ ")
-	key := path + fmt.Sprint(method)
-	res, ok := s.resources.Load("*" + fmt.Sprint(method))
-	if ok {
-		return res.(*r.CoAPResource)
+// observe registers or deregisters the sender of a GET request carrying the
+// Observe option. Returns the sequence number for the response if the sender
+// is now observing the resource.
+func (s *Server) observe(message *m.CoAPMessage, code m.CoapCode) (seq int, ok bool) {
+	option := message.GetOption(m.OptionObserve)
+	if option == nil || message.Code != m.GET {
+		return 0, false
 	}
-	res, ok = s.resources.Load(key)
-	if ok {
-		return res.(*r.CoAPResource)
+
+	switch option.IntValue() {
+	case 0:
+		if code.Group() == "2.xx" {
+			return s.observers.register(message), true
+		}
+	case 1:
+		s.observers.deregister(message.GetURIPath(), observerKey(message.Sender, message.Token))
 	}
-	return nil
+	return 0, false
+}
+
+func (s *Server) nilResultPolicy() NilResultPolicy {
+	return s.cfg.nilResultPolicy
+}
+
+func (s *Server) addResource(res *r.CoAPResource) *r.CoAPResource {
+	return s.router.Add(res)
+}
+
+func (s *Server) GET(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.addResource(r.NewCoAPResource(m.CoapMethodGet, path, handler, middlewares...))
+}
+
+func (s *Server) POST(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.addResource(r.NewCoAPResource(m.CoapMethodPost, path, handler, middlewares...))
+}
+
+func (s *Server) PUT(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.addResource(r.NewCoAPResource(m.CoapMethodPut, path, handler, middlewares...))
+}
+
+// Deprecated: use PUT.
+func (s *Server) AddPUTResource(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) {
+	s.PUT(path, handler, middlewares...)
+}
+
+// POSTStream registers a POST resource reading block-wise requests as they
+// arrive, see r.CoAPResourceStreamHandler.
+func (s *Server) POSTStream(path string, handler r.CoAPResourceStreamHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.addResource(r.NewCoAPStreamResource(m.CoapMethodPost, path, handler, middlewares...))
+}
+
+// PUTStream is like POSTStream for PUT.
+func (s *Server) PUTStream(path string, handler r.CoAPResourceStreamHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.addResource(r.NewCoAPStreamResource(m.CoapMethodPut, path, handler, middlewares...))
+}
+
+func (s *Server) DELETE(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.addResource(r.NewCoAPResource(m.CoapMethodDelete, path, handler, middlewares...))
+}
+
+func (s *Server) FETCH(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.addResource(r.NewCoAPResource(m.CoapMethodFetch, path, handler, middlewares...))
+}
+
+func (s *Server) PATCH(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.addResource(r.NewCoAPResource(m.CoapMethodPatch, path, handler, middlewares...))
+}
+
+func (s *Server) IPATCH(path string, handler r.CoAPResourceHandler, middlewares ...r.Middleware) *r.CoAPResource {
+	return s.addResource(r.NewCoAPResource(m.CoapMethodIPatch, path, handler, middlewares...))
+}
+
+// Use appends middlewares wrapping the handlers of all resources, outside
+// of the middlewares given to a single resource.
+func (s *Server) Use(middlewares ...r.Middleware) {
+	s.mx.Lock()
+	s.middlewares = append(s.middlewares, middlewares...)
+	s.mx.Unlock()
+}
+
+func (s *Server) getResourceForPathAndMethod(path string, method m.CoapMethod) (*r.CoAPResource, map[string]string) {
+	return s.router.Match(path, method)
+}
+
+// withMiddlewares wraps the handler picked for a request with the global
+// middlewares.
+func (s *Server) withMiddlewares(handler r.CoAPResourceHandler) r.CoAPResourceHandler {
+	s.mx.Lock()
+	middlewares := s.middlewares
+	s.mx.Unlock()
+
+	return r.Chain(handler, middlewares...)
+}
+
+func (s *Server) getMethodsForPath(path string) []m.CoapMethod {
+	return s.router.Methods(path)
 }
 
 func (s *Server) EnableProxy() {
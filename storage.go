@@ -8,8 +8,8 @@ import (
 )
 
 type sessionStorage interface {
-	Set(sender string, receiver string, proxy string, sess *session.SecuredSession)
-	Get(sender string, receiver string, proxy string) (*session.SecuredSession, bool)
+	Set(sender string, receiver string, proxy string, sess session.SecuredSession, expiration time.Duration)
+	Get(sender string, receiver string, proxy string) (session.SecuredSession, bool)
 	Delete(sender string, receiver string, proxy string)
 	ItemCount() int
 }
@@ -24,11 +24,11 @@ func newSessionStorageImpl() *sessionStorageImpl {
 	return s
 }
 
-func (s *sessionStorageImpl) Set(sender string, receiver string, proxy string, sess session.SecuredSession) {
+func (s *sessionStorageImpl) Set(sender string, receiver string, proxy string, sess session.SecuredSession, expiration time.Duration) {
 	if len(proxy) != 0 {
 		sender = "" //TODO понять надо ли это зануление
 	}
-	s.storage.SetDefault(sender+receiver+proxy, sess)
+	s.storage.Set(sender+receiver+proxy, sess, expiration)
 }
 
 func (s *sessionStorageImpl) Get(sender string, receiver string, proxy string) (session.SecuredSession, bool) {
@@ -2,10 +2,14 @@ package coalago
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	cerr "github.com/gusleein/coalago/errors"
@@ -26,15 +30,28 @@ type transport struct {
 	block2channels sync.Map
 	block1channels sync.Map
 	privateKey     []byte
+	cfg            *config
+	retransmits    int32
+	transfer       *transfer // streams bodies instead of keeping them in memory
 }
 
-func newtransport(conn dialer) *transport {
+func newtransport(conn dialer, cfg *config) *transport {
 	sr := new(transport)
 	sr.conn = conn
+	sr.cfg = cfg
 
 	return sr
 }
 
+func (sr *transport) retransmitted() {
+	util.MetricRetransmitMessages.Inc()
+	atomic.AddInt32(&sr.retransmits, 1)
+}
+
+func (sr *transport) retransmitCount() int {
+	return int(atomic.LoadInt32(&sr.retransmits))
+}
+
 func (tr *transport) SetPrivateKey(pk []byte) {
 	tr.privateKey = pk
 }
@@ -42,6 +59,11 @@ func (tr *transport) SetPrivateKey(pk []byte) {
 func (sr *transport) Send(message *m.CoAPMessage) (resp *m.CoAPMessage, err error) {
 	switch message.Type {
 	case m.CON:
+		ctx := messageContext(message)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		defer sr.watchContext(ctx)()
 
 		if message.GetScheme() == m.COAPS_SCHEME {
 			proxyAddr := message.ProxyAddr
@@ -80,6 +102,31 @@ func (sr *transport) Send(message *m.CoAPMessage) (resp *m.CoAPMessage, err erro
 	}
 }
 
+// messageContext returns the context the exchange of message is bound to.
+func messageContext(message *m.CoAPMessage) context.Context {
+	if message.Context != nil {
+		return message.Context
+	}
+	return context.Background()
+}
+
+// watchContext interrupts a blocking read on the connection once ctx is done,
+// so that receiveMessage returns ctx.Err() instead of waiting out the ACK timeout.
+func (sr *transport) watchContext(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			sr.conn.SetReadDeadlineSec(0)
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
 func (sr *transport) SendTo(message *m.CoAPMessage, addr net.Addr) (resp *m.CoAPMessage, err error) {
 	switch message.Type {
 	case m.ACK, m.NON, m.RST:
@@ -90,7 +137,7 @@ func (sr *transport) SendTo(message *m.CoAPMessage, addr net.Addr) (resp *m.CoAP
 }
 
 func (sr *transport) sendCON(message *m.CoAPMessage) (resp *m.CoAPMessage, err error) {
-	if isBigPayload(message) {
+	if sr.isBigPayload(message) || sr.transfer != nil && sr.transfer.body != nil {
 		resp, err = sr.sendARQBlock1CON(message)
 		return
 	}
@@ -100,11 +147,15 @@ func (sr *transport) sendCON(message *m.CoAPMessage) (resp *m.CoAPMessage, err e
 		return nil, err
 	}
 
+	ctx := messageContext(message)
 	attempts := 0
 
 	for {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
 		if attempts > 0 {
-			util.MetricRetransmitMessages.Inc()
+			sr.retransmitted()
 		}
 		attempts++
 		util.MetricSentMessages.Inc()
@@ -116,7 +167,7 @@ func (sr *transport) sendCON(message *m.CoAPMessage) (resp *m.CoAPMessage, err e
 
 		resp, err = receiveMessage(sr, message)
 		if err == cerr.MaxAttempts {
-			if attempts == maxSendAttempts {
+			if attempts == sr.cfg.maxSendAttempts {
 				util.MetricExpiredMessages.Inc()
 				return nil, err
 			}
@@ -140,19 +191,67 @@ func (sr *transport) sendCON(message *m.CoAPMessage) (resp *m.CoAPMessage, err e
 			return resp, err
 		}
 
+		// separate response whose empty ACK got lost
+		if resp.Type == m.CON {
+			if err = sr.sendToSocket(m.AckTo(message, resp, m.CoapCodeEmpty)); err != nil {
+				return nil, err
+			}
+		}
+
 		break
 	}
 
 	return
 }
 
+func (sr *transport) isBigPayload(message *m.CoAPMessage) bool {
+	if message.Body != nil {
+		return bodySize(message) > sr.cfg.blockSize
+	}
+	if message.Payload != nil {
+		return message.Payload.Length() > sr.cfg.blockSize
+	}
+
+	return false
+}
+
+// bodySize is the length of the Body of a response, given by its Size2.
+func bodySize(message *m.CoAPMessage) int {
+	if size := message.GetOption(m.OptionSize2); size != nil {
+		return size.IntValue()
+	}
+	return 0
+}
+
+// readBody turns the Body of a response fitting into a single message into
+// its payload.
+func readBody(message *m.CoAPMessage) error {
+	payload, err := ioutil.ReadAll(message.Body)
+	if err != nil {
+		return err
+	}
+	message.Payload = m.NewBytesPayload(payload)
+	message.Body = nil
+	return nil
+}
+
+// skipBody moves on by n bytes of body.
+func skipBody(body io.Reader, n int64) error {
+	if seeker, ok := body.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, body, n)
+	return err
+}
+
 func isPingACK(resp *m.CoAPMessage) bool {
 	return resp.Type == m.RST && resp.Code == m.CoapCodeEmpty
 }
 
 func (sr *transport) sendACKTo(message *m.CoAPMessage, addr net.Addr) (err error) {
 	if message.Type == m.ACK {
-		if isBigPayload(message) {
+		if sr.isBigPayload(message) {
 			ch := make(chan *m.CoAPMessage, 102400)
 			id := addr.String() + message.GetTokenString()
 			sr.block2channels.Store(id, ch)
@@ -161,6 +260,11 @@ func (sr *transport) sendACKTo(message *m.CoAPMessage, addr net.Addr) (err error
 			return err
 		}
 	}
+	if message.Body != nil {
+		if err = readBody(message); err != nil {
+			return err
+		}
+	}
 
 	return sr.sendToSocketByAddress(message, addr)
 }
@@ -194,7 +298,9 @@ func (sr *transport) sendToSocketByAddress(message *m.CoAPMessage, addr net.Addr
 	return err
 }
 
-func (sr *transport) sendPackets(packets []*packet, windowsize *int, shift int, relative_shift int, localMetricsRetransmitMessages *int, overflowIndicator *int) error {
+// sendPackets (re)sends the packets of the window whose ACK is overdue. A nil
+// packet has not been built yet and is made by next.
+func (sr *transport) sendPackets(packets []*packet, next func() (*m.CoAPMessage, error), windowsize *int, shift int, relative_shift int, localMetricsRetransmitMessages *int, overflowIndicator *int) error {
 	stop := *windowsize
 	if *overflowIndicator > 0 {
 		stop += shift
@@ -207,14 +313,21 @@ func (sr *transport) sendPackets(packets []*packet, windowsize *int, shift int,
 	var acked int
 
 	for i := shift; i < stop; i++ {
+		if packets[i] == nil {
+			blockMessage, err := next()
+			if err != nil {
+				return err
+			}
+			packets[i] = &packet{message: blockMessage}
+		}
 		if !packets[i].acked {
-			if time.Since(packets[i].lastSend) >= timeWait {
-				if packets[i].attempts > 0 && *windowsize >= MIN_WiNDOW_SIZE {
-					util.MetricRetransmitMessages.Inc()
+			if time.Since(packets[i].lastSend) >= sr.cfg.timeWait {
+				if packets[i].attempts > 0 && *windowsize >= sr.cfg.minWindowSize {
+					sr.retransmitted()
 					*localMetricsRetransmitMessages++
 				}
 
-				if packets[i].attempts == maxSendAttempts {
+				if packets[i].attempts == sr.cfg.maxSendAttempts {
 					util.MetricExpiredMessages.Inc()
 					return cerr.MaxAttempts
 				}
@@ -253,11 +366,11 @@ func (sr *transport) sendPacketsByWindowOffset(packets []*packet, windowsize, sh
 	var acked int
 	for i := start; i < stop; i++ {
 		if !packets[i].acked {
-			if time.Since(packets[i].lastSend) >= timeWait {
+			if time.Since(packets[i].lastSend) >= sr.cfg.timeWait {
 				if packets[i].attempts > 0 {
-					util.MetricRetransmitMessages.Inc()
+					sr.retransmitted()
 				}
-				if packets[i].attempts == maxSendAttempts {
+				if packets[i].attempts == sr.cfg.maxSendAttempts {
 					util.MetricExpiredMessages.Inc()
 					return cerr.MaxAttempts
 				}
@@ -273,7 +386,7 @@ func (sr *transport) sendPacketsByWindowOffset(packets []*packet, windowsize, sh
 	}
 
 	if len(packets) == stop {
-		if time.Since(packets[len(packets)-1].lastSend) >= timeWait {
+		if time.Since(packets[len(packets)-1].lastSend) >= sr.cfg.timeWait {
 			util.MetricExpiredMessages.Inc()
 			return cerr.MaxAttempts
 		}
@@ -298,11 +411,11 @@ func (sr *transport) sendPacketsByWindowOffsetToAddr(packets []*packet, windowsi
 	var acked int
 	for i := start; i < stop; i++ {
 		if !packets[i].acked {
-			if time.Since(packets[i].lastSend) >= timeWait {
+			if time.Since(packets[i].lastSend) >= sr.cfg.timeWait {
 				if packets[i].attempts > 0 {
-					util.MetricRetransmitMessages.Inc()
+					sr.retransmitted()
 				}
-				if packets[i].attempts == maxSendAttempts {
+				if packets[i].attempts == sr.cfg.maxSendAttempts {
 					util.MetricExpiredMessages.Inc()
 					return cerr.MaxAttempts
 				}
@@ -318,7 +431,7 @@ func (sr *transport) sendPacketsByWindowOffsetToAddr(packets []*packet, windowsi
 	}
 
 	if len(packets) == stop {
-		if time.Since(packets[len(packets)-1].lastSend) >= timeWait {
+		if time.Since(packets[len(packets)-1].lastSend) >= sr.cfg.timeWait {
 			util.MetricExpiredMessages.Inc()
 			return cerr.MaxAttempts
 		}
@@ -327,7 +440,8 @@ func (sr *transport) sendPacketsByWindowOffsetToAddr(packets []*packet, windowsi
 	return nil
 }
 
-func (sr *transport) sendPacketsToAddr(packets []*packet, windowsize *int, shift int, relative_shift int, localMetricsRetransmitMessages *int, overflowIndicator *int, addr net.Addr) error {
+// sendPacketsToAddr is sendPackets for the blocks of a response to addr.
+func (sr *transport) sendPacketsToAddr(packets []*packet, next func() (*m.CoAPMessage, error), windowsize *int, shift int, relative_shift int, localMetricsRetransmitMessages *int, overflowIndicator *int, addr net.Addr) error {
 	stop := *windowsize
 	if *overflowIndicator > 0 {
 		stop += shift
@@ -344,9 +458,16 @@ func (sr *transport) sendPacketsToAddr(packets []*packet, windowsize *int, shift
 
 	var acked int
 	for i := shift; i < stop; i++ {
+		if packets[i] == nil {
+			blockMessage, err := next()
+			if err != nil {
+				return err
+			}
+			packets[i] = &packet{message: blockMessage}
+		}
 		if !packets[i].acked {
-			if time.Since(packets[i].lastSend) >= timeWait {
-				if packets[i].attempts == maxSendAttempts {
+			if time.Since(packets[i].lastSend) >= sr.cfg.timeWait {
+				if packets[i].attempts == sr.cfg.maxSendAttempts {
 					util.MetricExpiredMessages.Inc()
 					return cerr.MaxAttempts
 				}
@@ -357,8 +478,8 @@ func (sr *transport) sendPacketsToAddr(packets []*packet, windowsize *int, shift
 
 				packets[i].attempts++
 
-				if packets[i].attempts > 1 && *windowsize > MIN_WiNDOW_SIZE {
-					util.MetricRetransmitMessages.Inc()
+				if packets[i].attempts > 1 && *windowsize > sr.cfg.minWindowSize {
+					sr.retransmitted()
 					*localMetricsRetransmitMessages++
 				}
 				packets[i].lastSend = time.Now()
@@ -377,40 +498,64 @@ func (sr *transport) sendPacketsToAddr(packets []*packet, windowsize *int, shift
 func (sr *transport) sendARQBlock1CON(message *m.CoAPMessage) (*m.CoAPMessage, error) {
 
 	state := new(m.StateSend)
-	state.Payload = message.Payload.Bytes()
-	state.Lenght = len(state.Payload)
+	if sr.transfer != nil && sr.transfer.body != nil {
+		state.Lenght = int(sr.transfer.size)
+	} else {
+		state.Payload = message.Payload.Bytes()
+		state.Lenght = len(state.Payload)
+	}
 	state.OrigMessage = message
-	state.BlockSize = MAX_PAYLOAD_SIZE
-	numblocks := math.Ceil(float64(state.Lenght) / float64(MAX_PAYLOAD_SIZE))
-	if int(numblocks) < DEFAULT_WINDOW_SIZE {
+	state.BlockSize = sr.cfg.blockSize
+	numblocks := math.Ceil(float64(state.Lenght) / float64(sr.cfg.blockSize))
+	if int(numblocks) < sr.cfg.windowSize {
 		state.Windowsize = int(numblocks)
 	} else {
-		state.Windowsize = DEFAULT_WINDOW_SIZE
+		state.Windowsize = sr.cfg.windowSize
 	}
 
-	packets := []*packet{}
-
-	for {
-		blockMessage, end := m.ConstructNextBlock(m.OptionBlock1, state)
-		packets = append(packets, &packet{
-			acked:   false,
-			message: blockMessage,
-		})
-
-		if end {
-			break
+	// blocks are built as the window reaches them and dropped once
+	// acknowledged, see sendPackets
+	packets := make([]*packet, int(numblocks))
+	ackedPacket := &packet{acked: true}
+	next := func() (*m.CoAPMessage, error) {
+		blockMessage, _ := m.ConstructNextBlock(m.OptionBlock1, state)
+		return blockMessage, nil
+	}
+	if state.Payload == nil {
+		next = func() (*m.CoAPMessage, error) {
+			blockMessage, _, err := m.ReadNextBlock(m.OptionBlock1, state, sr.transfer.body)
+			return blockMessage, err
 		}
 	}
 
+	// a resumed upload goes on from the first block the server misses, the
+	// body being read from there
 	var shift = 0
-	var relative_shift = 0
+	if sr.transfer != nil && sr.transfer.first > 0 && sr.transfer.first < len(packets) {
+		shift = sr.transfer.first
+		for i := 0; i < shift; i++ {
+			packets[i] = ackedPacket
+		}
+		state.NextNumBlock = shift
+		state.Start = shift * state.BlockSize
+	}
+
+	// a tagged upload sends the block it starts from alone, so that the
+	// server learns from it whether it has the blocks before (RFC 9175)
+	windowsize := state.Windowsize
+	probing := message.GetOption(m.OptionRequestTag) != nil
+	if probing {
+		state.Windowsize = 1
+	}
+
+	var relative_shift = shift
 	var localMetricsRetransmitMessages = 0
 	var downloadStartTime = time.Now()
 	var retransmitsTmp = 0
 	var balancerCounter = 0
 	var overflowIndicator = 0
 
-	err := sr.sendPackets(packets, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator)
+	err := sr.sendPackets(packets, next, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator)
 
 	if err != nil {
 		return nil, err
@@ -420,7 +565,7 @@ func (sr *transport) sendARQBlock1CON(message *m.CoAPMessage) (*m.CoAPMessage, e
 		resp, err := receiveMessage(sr, message)
 		if err != nil {
 			if err == cerr.MaxAttempts {
-				if err = sr.sendPackets(packets, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator); err != nil {
+				if err = sr.sendPackets(packets, next, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator); err != nil {
 					return nil, err
 				}
 				continue
@@ -443,13 +588,13 @@ func (sr *transport) sendARQBlock1CON(message *m.CoAPMessage) (*m.CoAPMessage, e
 				// if wo != nil {
 				// 	sr.sendPacketsByWindowOffset(packets, state.windowsize, shift, block.BlockNumber, int(wo.Value.(uint32)))
 				// }
-				if len(packets) >= block.BlockNumber {
+				if len(packets) > block.BlockNumber && packets[block.BlockNumber] != nil {
 					balancerCounter++
 					if resp.Code != m.CoapCodeContinue {
-						if len(packets) > DEFAULT_WINDOW_SIZE*2 {
+						if len(packets) > sr.cfg.windowSize*2 {
 							log.Debug(fmt.Sprintf("COALA U: %s, %s, Packets: %d Lost: %d, FinalWSize: %d",
 								util.ByteCountBinary(int64(state.Lenght)),
-								util.ByteCountBinaryBits(int64(state.Lenght)*time.Second.Milliseconds()/time.Since(downloadStartTime).Milliseconds()),
+								util.ByteCountBinaryBits(util.PerSecond(int64(state.Lenght), time.Since(downloadStartTime))),
 								len(packets),
 								localMetricsRetransmitMessages,
 								state.Windowsize))
@@ -459,18 +604,25 @@ func (sr *transport) sendARQBlock1CON(message *m.CoAPMessage) (*m.CoAPMessage, e
 					if !packets[block.BlockNumber].acked && packets[block.BlockNumber].attempts > 3 {
 						overflowIndicator--
 					}
-					packets[block.BlockNumber].acked = true
+					packets[block.BlockNumber] = ackedPacket
+					if probing {
+						probing = false
+						state.Windowsize = windowsize
+					}
 
 					relative_shift++
 					if block.BlockNumber == shift {
 						shift++
 						for _, p := range packets[shift:] {
-							if p.acked {
+							if p != nil && p.acked {
 								shift++
 							} else {
 								break
 							}
 						}
+						if sr.transfer != nil {
+							sr.transfer.offset = int64(shift * state.BlockSize)
+						}
 					}
 
 					if balancerCounter%25 == 0 {
@@ -478,16 +630,16 @@ func (sr *transport) sendARQBlock1CON(message *m.CoAPMessage) (*m.CoAPMessage, e
 						state.Windowsize += dt
 						retransmitsTmp = localMetricsRetransmitMessages
 
-						if state.Windowsize < MIN_WiNDOW_SIZE {
-							state.Windowsize = MIN_WiNDOW_SIZE
+						if state.Windowsize < sr.cfg.minWindowSize {
+							state.Windowsize = sr.cfg.minWindowSize
 						}
-						if state.Windowsize > MAX_WINDOW_SIZE {
-							state.Windowsize = MAX_WINDOW_SIZE
+						if state.Windowsize > sr.cfg.maxWindowSize {
+							state.Windowsize = sr.cfg.maxWindowSize
 						}
 
 					}
 
-					if err = sr.sendPackets(packets, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator); err != nil {
+					if err = sr.sendPackets(packets, next, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator); err != nil {
 						return nil, err
 					}
 
@@ -499,19 +651,21 @@ func (sr *transport) sendARQBlock1CON(message *m.CoAPMessage) (*m.CoAPMessage, e
 
 func (sr *transport) sendARQBlock2ACK(input chan *m.CoAPMessage, message *m.CoAPMessage, addr net.Addr) error {
 	state := new(m.StateSend)
-	state.Payload = message.Payload.Bytes()
-	state.Lenght = len(state.Payload)
+	if message.Body != nil {
+		state.Lenght = bodySize(message)
+	} else {
+		state.Payload = message.Payload.Bytes()
+		state.Lenght = len(state.Payload)
+	}
 	state.OrigMessage = message
-	state.BlockSize = MAX_PAYLOAD_SIZE
-	numblocks := math.Ceil(float64(state.Lenght) / float64(MAX_PAYLOAD_SIZE))
-	if int(numblocks) < DEFAULT_WINDOW_SIZE {
+	state.BlockSize = sr.cfg.blockSize
+	numblocks := math.Ceil(float64(state.Lenght) / float64(sr.cfg.blockSize))
+	if int(numblocks) < sr.cfg.windowSize {
 		state.Windowsize = int(numblocks)
 	} else {
-		state.Windowsize = DEFAULT_WINDOW_SIZE
+		state.Windowsize = sr.cfg.windowSize
 	}
 
-	packets := []*packet{}
-
 	emptyAckMessage := m.NewACKEmptyMessage(message, state.Windowsize)
 	err := sr.sendToSocketByAddress(emptyAckMessage, addr)
 	if err != nil {
@@ -519,27 +673,44 @@ func (sr *transport) sendARQBlock2ACK(input chan *m.CoAPMessage, message *m.CoAP
 	}
 	emptyAckMessage = nil
 
-	for {
-		blockMessage, end := m.ConstructNextBlock(m.OptionBlock2, state)
-		packets = append(packets, &packet{
-			acked:   false,
-			message: blockMessage,
-		})
-
-		if end {
-			break
+	// blocks are built as the window reaches them and dropped once
+	// acknowledged, see sendPacketsToAddr
+	packets := make([]*packet, int(numblocks))
+	ackedPacket := &packet{acked: true}
+	next := func() (*m.CoAPMessage, error) {
+		blockMessage, _ := m.ConstructNextBlock(m.OptionBlock2, state)
+		return blockMessage, nil
+	}
+	if message.Body != nil {
+		next = func() (*m.CoAPMessage, error) {
+			blockMessage, _, err := m.ReadNextBlock(m.OptionBlock2, state, message.Body)
+			return blockMessage, err
 		}
 	}
 
+	// a client resuming a download asks for the block to go on from
 	var shift = 0
-	var relative_shift = 0
+	if block := message.GetBlock2(); block != nil && block.BlockSize == state.BlockSize && block.BlockNumber < len(packets) {
+		shift = block.BlockNumber
+		for i := 0; i < shift; i++ {
+			packets[i] = ackedPacket
+		}
+		state.NextNumBlock = shift
+		state.Start = shift * state.BlockSize
+		if message.Body != nil {
+			if err := skipBody(message.Body, int64(state.Start)); err != nil {
+				return err
+			}
+		}
+	}
+	var relative_shift = shift
 	var localMetricsRetransmitMessages = 0
 	downloadStartTime := time.Now()
 	var retransmitsTmp = 0
 	var balancerCounter = 0
 	var overflowIndicator = 0
 
-	if err := sr.sendPacketsToAddr(packets, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator, addr); err != nil {
+	if err := sr.sendPacketsToAddr(packets, next, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator, addr); err != nil {
 		return err
 	}
 	for {
@@ -554,10 +725,10 @@ func (sr *transport) sendARQBlock2ACK(input chan *m.CoAPMessage, message *m.CoAP
 					if len(packets) >= block.BlockNumber {
 						balancerCounter++
 						if resp.Code != m.CoapCodeContinue {
-							if len(packets) > DEFAULT_WINDOW_SIZE*2 {
+							if len(packets) > sr.cfg.windowSize*2 {
 								log.Debug(fmt.Sprintf("COALA U: %s, %s, Packets: %d Lost: %d, FinalWSize: %d",
 									util.ByteCountBinary(int64(state.Lenght)),
-									util.ByteCountBinaryBits(int64(state.Lenght)*time.Second.Milliseconds()/time.Since(downloadStartTime).Milliseconds()),
+									util.ByteCountBinaryBits(util.PerSecond(int64(state.Lenght), time.Since(downloadStartTime))),
 									len(packets),
 									localMetricsRetransmitMessages,
 									state.Windowsize))
@@ -571,15 +742,18 @@ func (sr *transport) sendARQBlock2ACK(input chan *m.CoAPMessage, message *m.CoAP
 							// 	sr.sendPacketsByWindowOffset(packets, state.windowsize, shift, block.BlockNumber, int(wov))
 
 							// }
+							if packets[block.BlockNumber] == nil {
+								continue
+							}
 							if !packets[block.BlockNumber].acked && packets[block.BlockNumber].attempts > 3 {
 								overflowIndicator--
 							}
-							packets[block.BlockNumber].acked = true
+							packets[block.BlockNumber] = ackedPacket
 							relative_shift++
 							if block.BlockNumber == shift {
 								shift++
 								for _, p := range packets[shift:] {
-									if p.acked {
+									if p != nil && p.acked {
 										shift++
 									} else {
 										break
@@ -592,23 +766,23 @@ func (sr *transport) sendARQBlock2ACK(input chan *m.CoAPMessage, message *m.CoAP
 								state.Windowsize += dt
 								retransmitsTmp = localMetricsRetransmitMessages
 
-								if state.Windowsize < MIN_WiNDOW_SIZE {
-									state.Windowsize = MIN_WiNDOW_SIZE
+								if state.Windowsize < sr.cfg.minWindowSize {
+									state.Windowsize = sr.cfg.minWindowSize
 								}
-								if state.Windowsize > MAX_WINDOW_SIZE {
-									state.Windowsize = MAX_WINDOW_SIZE
+								if state.Windowsize > sr.cfg.maxWindowSize {
+									state.Windowsize = sr.cfg.maxWindowSize
 								}
 							}
 
-							if err := sr.sendPacketsToAddr(packets, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator, addr); err != nil {
+							if err := sr.sendPacketsToAddr(packets, next, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator, addr); err != nil {
 								return err
 							}
 						}
 					}
 				}
 			}
-		case <-time.After(timeWait):
-			if err := sr.sendPacketsToAddr(packets, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator, addr); err != nil {
+		case <-time.After(sr.cfg.timeWait):
+			if err := sr.sendPacketsToAddr(packets, next, &state.Windowsize, shift, relative_shift, &localMetricsRetransmitMessages, &overflowIndicator, addr); err != nil {
 				return err
 			}
 		}
@@ -652,7 +826,7 @@ func (sr *transport) receiveARQBlock1(input chan *m.CoAPMessage) (*m.CoAPMessage
 				return nil, err
 			}
 
-		case <-time.After(timeWait):
+		case <-time.After(sr.cfg.timeWait):
 			util.MetricExpiredMessages.Inc()
 			return nil, cerr.MaxAttempts
 		}
@@ -660,47 +834,43 @@ func (sr *transport) receiveARQBlock1(input chan *m.CoAPMessage) (*m.CoAPMessage
 }
 
 func (sr *transport) receiveARQBlock2(origMessage *m.CoAPMessage, inputMessage *m.CoAPMessage) (rsp *m.CoAPMessage, err error) {
-	buf := make(map[int][]byte)
-	totalBlocks := -1
-	var attempts int
+	var body *bytes.Buffer
+	var blocks *util.BlockWriter
+	var attempts int // reads timed out, nothing is sent again meanwhile
+
+	// after an empty ACK the response comes once the handler is done, which
+	// takes as long as it takes rather than a number of retransmissions,
+	// if the client is willing to wait for it
+	var separateDeadline time.Time
+	if inputMessage == nil && sr.cfg.separateResponseTimeout > 0 {
+		separateDeadline = time.Now().Add(sr.cfg.separateResponseTimeout)
+	}
 
 	if inputMessage != nil {
 		block := inputMessage.GetBlock2()
 
 		if block != nil && inputMessage.Type == m.CON {
-			if !block.MoreBlocks {
-				totalBlocks = block.BlockNumber + 1
-			}
-			buf[block.BlockNumber] = inputMessage.Payload.Bytes()
-			if totalBlocks == len(buf) {
-				b := []byte{}
-				for i := 0; i < totalBlocks; i++ {
-					b = append(b, buf[i]...)
-				}
-				inputMessage.Payload = m.NewBytesPayload(b)
-
-				ack := m.AckTo(origMessage, inputMessage, m.CoapCodeEmpty)
-				sr.sendToSocket(ack)
-				return inputMessage, nil
+			blocks, body = sr.newBlock2Writer(inputMessage)
+			done, err := sr.ackBlock2(origMessage, inputMessage, block, blocks)
+			if err != nil {
+				return nil, err
 			}
-
-			var ack *m.CoAPMessage
-			w := inputMessage.GetOption(m.OptionSelectiveRepeatWindowSize)
-			if w != nil {
-				ack = m.AckToWithWindowOffset(origMessage, inputMessage, m.CoapCodeContinue, w.IntValue(), block.BlockNumber, buf)
-			} else {
-				ack = m.AckTo(origMessage, inputMessage, m.CoapCodeContinue)
+			if done {
+				return block2Result(inputMessage, body), nil
 			}
-			sr.sendToSocket(ack)
 		}
 	}
 
 	downloadStartTime := time.Now()
 
 	for {
+		separate := !separateDeadline.IsZero()
+		if separate {
+			origMessage.Timeout = time.Until(separateDeadline)
+		}
 		inputMessage, err = receiveMessage(sr, origMessage)
 		if err == cerr.MaxAttempts {
-			if attempts == maxSendAttempts {
+			if separate || attempts == sr.cfg.maxSendAttempts {
 				util.MetricExpiredMessages.Inc()
 				return nil, err
 			}
@@ -711,50 +881,107 @@ func (sr *transport) receiveARQBlock2(origMessage *m.CoAPMessage, inputMessage *
 			return nil, err
 		}
 
-		if attempts > 0 {
-			util.MetricRetransmitMessages.Inc()
-		}
-		block := inputMessage.GetBlock2()
-		if block == nil || inputMessage.Type != m.CON {
+		if inputMessage.Type != m.CON {
 			continue
 		}
-
-		if !block.MoreBlocks {
-			totalBlocks = block.BlockNumber + 1
-		}
-
-		buf[block.BlockNumber] = inputMessage.Payload.Bytes()
-
-		if totalBlocks == len(buf) {
-			b := []byte{}
-			for i := 0; i < totalBlocks; i++ {
-				b = append(b, buf[i]...)
-			}
-			inputMessage.Payload = m.NewBytesPayload(b)
+		separateDeadline = time.Time{}
+		block := inputMessage.GetBlock2()
+		if block == nil {
+			// separate response that fits into a single message
 			ack := m.AckTo(origMessage, inputMessage, m.CoapCodeEmpty)
 			if err = sr.sendToSocket(ack); err != nil {
 				return nil, err
 			}
-			if len(buf) > DEFAULT_WINDOW_SIZE*2 {
-				log.Debug(fmt.Sprintf("COALA D: %s, %s",
-					util.ByteCountBinary(int64(len(b))),
-					util.ByteCountBinaryBits(int64(len(b))*time.Second.Milliseconds()/time.Since(downloadStartTime).Milliseconds())))
-			}
 			return inputMessage, nil
 		}
 
-		var ack *m.CoAPMessage
-		w := inputMessage.GetOption(m.OptionSelectiveRepeatWindowSize)
-		if w != nil {
-			ack = m.AckToWithWindowOffset(origMessage, inputMessage, m.CoapCodeContinue, w.IntValue(), block.BlockNumber, buf)
-		} else {
-			ack = m.AckTo(origMessage, inputMessage, m.CoapCodeContinue)
+		if blocks == nil {
+			blocks, body = sr.newBlock2Writer(inputMessage)
 		}
-
-		if err = sr.sendToSocket(ack); err != nil {
+		done, err := sr.ackBlock2(origMessage, inputMessage, block, blocks)
+		if err != nil {
 			return nil, err
 		}
+		if done {
+			if blocks.Next > sr.cfg.windowSize*2 {
+				log.Debug(fmt.Sprintf("COALA D: %s, %s",
+					util.ByteCountBinary(blocks.Written),
+					util.ByteCountBinaryBits(util.PerSecond(blocks.Written, time.Since(downloadStartTime)))))
+			}
+			return block2Result(inputMessage, body), nil
+		}
+	}
+}
+
+// newBlock2Writer returns where the blocks of the response message belongs
+// to go: the output of a download if the response is 2.xx, otherwise a
+// buffer becoming the payload of the response.
+func (sr *transport) newBlock2Writer(message *m.CoAPMessage) (*util.BlockWriter, *bytes.Buffer) {
+	if sr.streamsBlock2(message) {
+		blocks := util.NewBlockWriter(sr.transfer.output, sr.transfer.progress)
+		blocks.Next = sr.transfer.first
+		blocks.Written = int64(sr.transfer.first * sr.transfer.blockSize)
+		return blocks, nil
+	}
+	body := new(bytes.Buffer)
+	return util.NewBlockWriter(body, nil), body
+}
+
+func (sr *transport) streamsBlock2(message *m.CoAPMessage) bool {
+	return sr.transfer != nil && sr.transfer.output != nil && message.Code.Group() == "2.xx"
+}
+
+// ackBlock2 hands a received block over to blocks and acknowledges it,
+// reporting whether it completed the transfer. A block dropped by blocks
+// is left unacknowledged for the sender to repeat.
+func (sr *transport) ackBlock2(origMessage, inputMessage *m.CoAPMessage, block *util.Block, blocks *util.BlockWriter) (done bool, err error) {
+	if size := inputMessage.GetOption(m.OptionSize2); size != nil {
+		blocks.Size = int64(size.IntValue())
+	}
+
+	// a streamed body keeps no more blocks than the largest window in
+	// memory, the window size in the blocks is the one they were built with
+	limit := 0
+	streams := sr.streamsBlock2(inputMessage)
+	if streams {
+		limit = sr.cfg.maxWindowSize
+		if err := sr.transfer.check(inputMessage, block); err != nil {
+			return false, err
+		}
+	}
+	w := inputMessage.GetOption(m.OptionSelectiveRepeatWindowSize)
+
+	stored, err := blocks.Put(block.BlockNumber, inputMessage.Payload.Bytes(), block.MoreBlocks, limit)
+	if streams {
+		sr.transfer.offset = blocks.Written
+	}
+	if err != nil || !stored {
+		return false, err
+	}
+
+	if blocks.Done() {
+		return true, sr.sendToSocket(m.AckTo(origMessage, inputMessage, m.CoapCodeEmpty))
+	}
+
+	var ack *m.CoAPMessage
+	if w != nil {
+		ack = m.AckToWithWindowOffset(origMessage, inputMessage, m.CoapCodeContinue, w.IntValue(), block.BlockNumber, nil)
+	} else {
+		ack = m.AckTo(origMessage, inputMessage, m.CoapCodeContinue)
+	}
+	return false, sr.sendToSocket(ack)
+}
+
+// block2Result turns the block completing a transfer into the response,
+// whose payload is the body collected in memory or empty if it was
+// written out.
+func block2Result(last *m.CoAPMessage, body *bytes.Buffer) *m.CoAPMessage {
+	if body != nil {
+		last.Payload = m.NewBytesPayload(body.Bytes())
+	} else {
+		last.Payload = m.NewEmptyPayload()
 	}
+	return last
 }
 
 func preparationSendingMessage(tr *transport, message *m.CoAPMessage, addr net.Addr) ([]byte, error) {
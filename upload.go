@@ -0,0 +1,31 @@
+package coalago
+
+import (
+	"context"
+	"io"
+
+	m "github.com/gusleein/coalago/message"
+)
+
+// Upload POSTs size bytes read from body to url. The blocks are read as the
+// selective repeat window reaches them and released once acknowledged, so
+// that only the blocks in flight are held in memory.
+func (c *Client) Upload(ctx context.Context, url string, body io.Reader, size int64, options ...*m.CoAPMessageOption) (*Response, error) {
+	message, err := constructMessage(m.POST, url)
+	if err != nil {
+		return nil, err
+	}
+	message.AddOptions(options)
+	message.Context = ctx
+
+	if size <= int64(c.cfg.blockSize) {
+		data := make([]byte, size)
+		if _, err = io.ReadFull(body, data); err != nil {
+			return nil, err
+		}
+		message.Payload = m.NewBytesPayload(data)
+		return c.exchange(message, message.Recipient.String(), nil)
+	}
+
+	return c.exchange(message, message.Recipient.String(), &transfer{body: body, size: size})
+}
@@ -0,0 +1,72 @@
+package util
+
+import "io"
+
+// BlockWriter writes the blocks of a block-wise transfer to its writer in
+// order. Blocks arriving ahead of the next one wait until it comes.
+type BlockWriter struct {
+	Next    int   // number of the block to be written next
+	Total   int   // number of blocks, -1 until the last one arrives
+	Written int64 // bytes written
+	Size    int64 // size announced by the sender, -1 if unknown
+
+	w        io.Writer
+	progress func(done, total int64)
+	pending  map[int][]byte
+}
+
+// NewBlockWriter returns a BlockWriter to w. progress, if not nil, is
+// called after every write with Written and Size.
+func NewBlockWriter(w io.Writer, progress func(done, total int64)) *BlockWriter {
+	return &BlockWriter{
+		Total:    -1,
+		Size:     -1,
+		w:        w,
+		progress: progress,
+		pending:  make(map[int][]byte),
+	}
+}
+
+// Hold keeps a block to be written by Put once the blocks before it are.
+func (bw *BlockWriter) Hold(num int, data []byte) {
+	bw.pending[num] = data
+}
+
+// Put stores a block and writes out every block it makes contiguous. A block
+// limit or more blocks ahead of the next one is dropped and reported as not
+// stored, limit 0 meaning no limit. Blocks already written are ignored.
+func (bw *BlockWriter) Put(num int, data []byte, more bool, limit int) (stored bool, err error) {
+	if num < bw.Next {
+		return true, nil
+	}
+	if limit > 0 && num >= bw.Next+limit {
+		return false, nil
+	}
+	if !more {
+		bw.Total = num + 1
+	}
+	bw.pending[num] = data
+
+	for {
+		data, ok := bw.pending[bw.Next]
+		if !ok {
+			return true, nil
+		}
+		delete(bw.pending, bw.Next)
+
+		n, err := bw.w.Write(data)
+		bw.Written += int64(n)
+		if err != nil {
+			return false, err
+		}
+		bw.Next++
+		if bw.progress != nil {
+			bw.progress(bw.Written, bw.Size)
+		}
+	}
+}
+
+// Done reports whether all the blocks are written.
+func (bw *BlockWriter) Done() bool {
+	return bw.Total >= 0 && bw.Next >= bw.Total
+}
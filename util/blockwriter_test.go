@@ -0,0 +1,39 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBlockWriterOrder(t *testing.T) {
+	var out bytes.Buffer
+	var progress []int64
+	bw := NewBlockWriter(&out, func(done, total int64) { progress = append(progress, done) })
+
+	steps := []struct {
+		num    int
+		data   string
+		more   bool
+		stored bool
+	}{
+		{2, "c", true, true},
+		{5, "f", true, false}, // beyond the limit
+		{0, "a", true, true},
+		{0, "a", true, true}, // repeated
+		{3, "d", false, true},
+		{1, "b", true, true},
+	}
+	for i, step := range steps {
+		stored, err := bw.Put(step.num, []byte(step.data), step.more, 3)
+		if err != nil || stored != step.stored {
+			t.Fatalf("%d: got %v %v, want %v", i, stored, err, step.stored)
+		}
+	}
+
+	if !bw.Done() || out.String() != "abcd" || len(bw.pending) != 0 {
+		t.Fatalf("got %q, done %v, pending %d", out.String(), bw.Done(), len(bw.pending))
+	}
+	if len(progress) != 4 || progress[3] != 4 {
+		t.Errorf("progress %v", progress)
+	}
+}
@@ -1,6 +1,19 @@
 package util
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
+
+// PerSecond returns the rate of n per second over the elapsed time,
+// transfers finishing within a millisecond count as taking one.
+func PerSecond(n int64, elapsed time.Duration) int64 {
+	ms := elapsed.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return n * time.Second.Milliseconds() / ms
+}
 
 func ByteCountBinaryBits(b int64) string {
 	b *= 8
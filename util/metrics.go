@@ -11,7 +11,11 @@ var (
 	MetricSentMessageErrors,
 	MetricSessionsRate,
 	MetricSessionsCount,
-	MetricSuccessfulHandhshakes counterImpl
+	MetricSuccessfulHandhshakes,
+	MetricHandlerPanics,
+	MetricCacheHits,
+	MetricCacheMisses,
+	MetricCacheRevalidations counterImpl
 )
 
 type Counter interface {